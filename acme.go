@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeCacheDir is where account keys and certificates obtained from
+// acmeDirectory are kept, one directory per ACME server.
+func acmeCacheDir() (string, error) {
+	u, err := url.Parse(acmeDirectory)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid ACME directory URL %q", acmeDirectory)
+	}
+
+	// Windows forbids colons, e.g. before a port, in file names
+	return filepath.Join(configDir, "acme", strings.ReplaceAll(u.Host, ":", "_")), nil
+}
+
+// acmeDomainList splits the -acme-domains flag.
+func acmeDomainList() []string {
+	var domains []string
+	for _, d := range strings.Split(acmeDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+
+	return domains
+}
+
+// tlsConfigACME obtains (and renews) certificates for acmeDomains from
+// acmeDirectory.  Challenges are answered over TLS-ALPN-01 by the returned
+// config, and over HTTP-01 by the manager's HTTPHandler.
+func tlsConfigACME() (*tls.Config, *autocert.Manager, error) {
+	cacheDir, err := acmeCacheDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	client := &acme.Client{DirectoryURL: acmeDirectory}
+	if acmeDirectoryCA != "" {
+		// e.g. a test server such as Pebble, whose certificate isn't
+		// publicly trusted
+		roots, err := loadCertPool(acmeDirectoryCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	domains := acmeDomainList()
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Client:     client,
+		Email:      acmeEmail,
+	}
+	log.Printf("Using certificates for %s from %s, stored in %s", strings.Join(domains, ", "), acmeDirectory, cacheDir)
+
+	return m.TLSConfig(), m, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemCerts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
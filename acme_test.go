@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACMEFlags(t *testing.T) {
+	oldDomains, oldDirectory, oldConfigDir := acmeDomains, acmeDirectory, configDir
+	t.Cleanup(func() { acmeDomains, acmeDirectory, configDir = oldDomains, oldDirectory, oldConfigDir })
+
+	acmeDomains = " files.example.com,,www.example.com "
+	acmeDirectory = "https://localhost:14000/dir"
+	configDir = "/config"
+
+	require.Equal(t, []string{"files.example.com", "www.example.com"}, acmeDomainList())
+
+	dir, err := acmeCacheDir()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("/config", "acme", "localhost_14000"), dir)
+
+	acmeDirectory = "localhost"
+	_, err = acmeCacheDir()
+	require.Error(t, err)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/stensonb/fileserver/pkg/auth"
+	"github.com/stensonb/fileserver/pkg/certs"
+	"github.com/stensonb/fileserver/pkg/clientauth"
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+	"github.com/stensonb/fileserver/pkg/upload"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the environment variable for each flag, e.g.
+// FILESERVER_UPLOAD_CONFLICT for -upload-conflict.
+const envPrefix = "FILESERVER_"
+
+// repeatedValue is a flag which may be given several times.  In an
+// environment variable its values are comma separated, in the config file
+// they're a list.
+type repeatedValue interface {
+	flag.Value
+	Values() []string
+}
+
+var _ repeatedValue = &addressFlag{}
+var _ repeatedValue = &listenFlag{}
+var _ repeatedValue = &ipfilter.Prefixes{}
+
+// envName is the environment variable setting the named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig applies the config file named by the -config flag, if any, and
+// the environment to the flags which weren't given on the command line:
+// flags take precedence over the environment, which takes precedence over
+// the file.
+func loadConfig(flags *flag.FlagSet) error {
+	configPath := flagOrEnv(flags, "config")
+	explicitPath := configPath != ""
+	if !explicitPath {
+		configPath = filepath.Join(flagOrEnv(flags, "config-dir"), "config.yaml")
+	}
+
+	file := map[string]any{}
+	b, err := os.ReadFile(configPath)
+	switch {
+	case err == nil:
+		if err := yaml.Unmarshal(b, &file); err != nil {
+			return fmt.Errorf("config file %s: %w", configPath, err)
+		}
+	case errors.Is(err, fs.ErrNotExist) && !explicitPath:
+		// the default config file is optional
+	default:
+		return err
+	}
+
+	return applyConfig(flags, configPath, file, os.LookupEnv)
+}
+
+// flagOrEnv returns the named flag's value if it was given, or else its
+// environment variable's, or else its default, as applyConfig would but for
+// the config file.
+func flagOrEnv(flags *flag.FlagSet, name string) string {
+	f := flags.Lookup(name)
+	given := false
+	flags.Visit(func(visited *flag.Flag) { given = given || visited == f })
+	if env, ok := os.LookupEnv(envName(name)); ok && !given {
+		return env
+	}
+
+	return f.Value.String()
+}
+
+// unconfigurable flags only make sense on the command line.
+var unconfigurable = []string{"config", "print-config", "share", "upload-request"}
+
+func applyConfig(flags *flag.FlagSet, configPath string, file map[string]any, lookupEnv func(string) (string, bool)) error {
+	for name := range file {
+		if flags.Lookup(name) == nil || slices.Contains(unconfigurable, name) {
+			return fmt.Errorf("config file %s: unknown setting %q", configPath, name)
+		}
+	}
+
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || slices.Contains(unconfigurable, f.Name) {
+			return
+		}
+
+		if env, ok := lookupEnv(envName(f.Name)); ok {
+			values := []string{env}
+			if _, repeated := f.Value.(repeatedValue); repeated {
+				values = strings.Split(env, ",")
+			}
+			if err := setFlag(flags, f, values); err != nil {
+				errs = append(errs, fmt.Errorf("environment variable %s: %w", envName(f.Name), err))
+			}
+			return
+		}
+
+		if v, ok := file[f.Name]; ok {
+			values, err := configValues(f, v)
+			if err == nil {
+				err = setFlag(flags, f, values)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("config file %s: %s: %w", configPath, f.Name, err))
+			}
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// configValues converts a value from the config file to the flag's string
+// form, or several for a repeated flag given as a list.
+func configValues(f *flag.Flag, v any) ([]string, error) {
+	list, isList := v.([]any)
+	if !isList {
+		return []string{scalarString(v)}, nil
+	}
+	if _, repeated := f.Value.(repeatedValue); !repeated {
+		return nil, errors.New("takes a single value, not a list")
+	}
+
+	values := make([]string, len(list))
+	for i, item := range list {
+		values[i] = scalarString(item)
+	}
+
+	return values, nil
+}
+
+func scalarString(v any) string {
+	if v == nil {
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+func setFlag(flags *flag.FlagSet, f *flag.Flag, values []string) error {
+	for _, v := range values {
+		if err := flags.Set(f.Name, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printConfig writes the effective configuration in the config file's
+// format.
+func printConfig(w io.Writer, flags *flag.FlagSet) error {
+	config := map[string]any{}
+	flags.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(unconfigurable, f.Name) {
+			return
+		}
+
+		switch v := f.Value.(type) {
+		case repeatedValue:
+			config[f.Name] = v.Values()
+		case flag.Getter:
+			config[f.Name] = v.Get()
+		default:
+			config[f.Name] = v.String()
+		}
+	})
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer func() { _ = enc.Close() }()
+
+	return enc.Encode(config)
+}
+
+// validateConfig checks settings which can't be checked while parsing
+// flags, so mistakes are reported before anything starts.
+func validateConfig() error {
+	var errs []error
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	checkDuration := func(name, value string) {
+		_, err := time.ParseDuration(value)
+		check(name, err)
+	}
+	checkPort := func(name string, port int, zeroOK bool) {
+		if port < 0 || port > 65535 || (port == 0 && !zeroOK) {
+			check(name, fmt.Errorf("%d is not a valid port", port))
+		}
+	}
+
+	checkDuration("upload-stale-age", uploadStaleAge)
+	checkDuration("timeout", shutdownTimeout)
+	checkDuration("tls-validity", tlsValidity)
+	checkDuration("pin-rotate", pinRotate)
+	checkDuration("share-expiry", shareExpiry)
+	checkDuration("upload-request-expiry", uploadRequestExpiry)
+	checkPort("port", listenPort, false)
+	checkPort("http-redirect-port", httpRedirectPort, true)
+
+	_, err := upload.ParseConflictPolicy(uploadConflict)
+	check("upload-conflict", err)
+	_, err = certs.ParseKeyType(tlsKeyType)
+	check("tls-key-type", err)
+	downloadAuth, uploadAuth, err := clientAuthModes()
+	check("tls-client-auth", err)
+
+	if err == nil && (downloadAuth != clientauth.None || uploadAuth != clientauth.None) {
+		if !tlsEnabled || tlsClientCA == "" {
+			check("tls-client-auth", errors.New("needs tls and tls-client-ca"))
+		}
+	}
+	if httpRedirectPort != 0 && !tlsEnabled {
+		check("http-redirect-port", errors.New("needs tls"))
+	}
+	_, err = auth.ParseRoles(authDefaultRoles)
+	check("auth-default-roles", err)
+	_, err = auth.ParseRoles(authAnonymousRoles)
+	check("auth-anonymous-roles", err)
+
+	if pinQRCode && !pairingEnabled {
+		check("pin-qrcode", errors.New("needs pin"))
+	}
+
+	if acmeDomains != "" {
+		_, err := acmeCacheDir()
+		check("acme-directory", err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func testFlags(t *testing.T, args ...string) (*flag.FlagSet, *string, *int, *addressFlag) {
+	t.Helper()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	conflict := flags.String("upload-conflict", "overwrite", "")
+	port := flags.Int("port", 1234, "")
+	addresses := &addressFlag{values: []string{"192.168.1.10"}}
+	flags.Var(addresses, "address", "")
+	require.NoError(t, flags.Parse(args))
+
+	return flags, conflict, port, addresses
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	file := map[string]any{
+		"upload-conflict": "rename",
+		"port":            8080,
+		"address":         []any{"10.0.0.1", "::1"},
+	}
+	env := map[string]string{
+		"FILESERVER_PORT":    "9090",
+		"FILESERVER_ADDRESS": "10.0.0.2,10.0.0.3",
+	}
+	lookupEnv := func(k string) (string, bool) { v, ok := env[k]; return v, ok }
+
+	// the file beats the defaults
+	flags, conflict, port, addresses := testFlags(t)
+	require.NoError(t, applyConfig(flags, "config.yaml", file, func(string) (string, bool) { return "", false }))
+	require.Equal(t, "rename", *conflict)
+	require.Equal(t, 8080, *port)
+	require.Equal(t, []string{"10.0.0.1", "::1"}, addresses.values)
+
+	// the environment beats the file
+	flags, conflict, port, addresses = testFlags(t)
+	require.NoError(t, applyConfig(flags, "config.yaml", file, lookupEnv))
+	require.Equal(t, "rename", *conflict)
+	require.Equal(t, 9090, *port)
+	require.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, addresses.values)
+
+	// and flags beat everything
+	flags, conflict, port, addresses = testFlags(t, "-port", "1", "-address", "127.0.0.1", "-upload-conflict", "reject")
+	require.NoError(t, applyConfig(flags, "config.yaml", file, lookupEnv))
+	require.Equal(t, "reject", *conflict)
+	require.Equal(t, 1, *port)
+	require.Equal(t, []string{"127.0.0.1"}, addresses.values)
+}
+
+func TestLoadConfigFromEnvConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("upload-conflict: version\n"), 0600))
+	t.Setenv(envName("config-dir"), dir)
+
+	flags, conflict, _, _ := testFlags(t)
+	flags.String("config", "", "")
+	flags.String("config-dir", t.TempDir(), "")
+
+	// the config file is looked for in the config directory the
+	// environment names, like everything else kept there
+	require.NoError(t, loadConfig(flags))
+	require.Equal(t, "version", *conflict)
+	require.Equal(t, dir, flags.Lookup("config-dir").Value.String())
+
+	// unless the flag names another
+	flags, conflict, _, _ = testFlags(t)
+	flags.String("config", "", "")
+	flags.String("config-dir", "", "")
+	require.NoError(t, flags.Parse([]string{"-config-dir", t.TempDir()}))
+	require.NoError(t, loadConfig(flags))
+	require.Equal(t, "overwrite", *conflict)
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	flags, _, _, _ := testFlags(t)
+	err := applyConfig(flags, "config.yaml", map[string]any{"prot": 80}, noEnv)
+	require.ErrorContains(t, err, `unknown setting "prot"`)
+
+	flags, _, _, _ = testFlags(t)
+	err = applyConfig(flags, "config.yaml", map[string]any{"port": []any{80, 81}}, noEnv)
+	require.ErrorContains(t, err, "config file config.yaml: port: takes a single value")
+
+	flags, _, _, _ = testFlags(t)
+	err = applyConfig(flags, "config.yaml", nil, func(k string) (string, bool) { return "eighty", k == "FILESERVER_PORT" })
+	require.ErrorContains(t, err, "environment variable FILESERVER_PORT")
+}
+
+func TestPrintConfig(t *testing.T) {
+	flags, _, _, _ := testFlags(t, "-port", "8080")
+
+	var b bytes.Buffer
+	require.NoError(t, printConfig(&b, flags))
+
+	// what's printed can be read back as a config file
+	var printed map[string]any
+	require.NoError(t, yaml.Unmarshal(b.Bytes(), &printed))
+	require.Equal(t, map[string]any{
+		"upload-conflict": "overwrite",
+		"port":            8080,
+		"address":         []any{"192.168.1.10"},
+	}, printed)
+
+	flags, _, port, _ := testFlags(t)
+	require.NoError(t, applyConfig(flags, "printed", printed, func(string) (string, bool) { return "", false }))
+	require.Equal(t, 8080, *port)
+}
@@ -2,18 +2,18 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"embed"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
-	"math/big"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
@@ -22,23 +22,52 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	qrcode "github.com/skip2/go-qrcode"
-	"github.com/stensonb/fileserver/pkg/safepath"
-	"github.com/stensonb/fileserver/pkg/unveil"
+	"github.com/stensonb/fileserver/pkg/auth"
+	"github.com/stensonb/fileserver/pkg/certs"
+	"github.com/stensonb/fileserver/pkg/clientauth"
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+	"github.com/stensonb/fileserver/pkg/pairing"
+	"github.com/stensonb/fileserver/pkg/sandbox"
+	"github.com/stensonb/fileserver/pkg/share"
+	"github.com/stensonb/fileserver/pkg/tus"
+	"github.com/stensonb/fileserver/pkg/upload"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
 	domain = "siliconvortex.com"
 	name   = "fileserver"
+
+	// tusDirName is the hidden folder inside uploadDir holding partial
+	// resumable uploads, so completed ones can be renamed into place.
+	tusDirName = ".tus"
+
+	// uploadReportInterval is how often uploads still in progress are
+	// logged while shutting down.
+	uploadReportInterval = 10 * time.Second
 )
 
 var dataDir string
 var uploadDir string
-var listenAddress string = getLocalIP()
+var uploadConflict string = string(upload.Overwrite)
+var uploadStaleAge string = "24h"
+var uploadMaxDepth uint = upload.DefaultMaxDepth
+var maxUploadSize int64
+var uploadQuota int64
+var clientDailyQuota int64
+var minFreeSpace int64
+var store *upload.Store
+var limiter *upload.Limiter
+var shares *share.Shares
+var uploads = newTransfers()
+var listenAddresses = addressFlag{values: []string{getLocalIP()}}
+var listenSockets listenFlag
 var listenPort int = 1234
 var printQRCode bool = true
 var shutdownTimeout string = "60s"
@@ -46,6 +75,38 @@ var tlsEnabled bool = true
 var tlsSelfSigned bool = true
 var tlsCertPath string = "cert.pem"
 var tlsKeyPath string = "cert.key"
+var tlsKeyType string = string(certs.ECDSA)
+var tlsValidity string = "168h"
+var configDir string
+var acmeDirectory string = autocert.DefaultACMEDirectory
+var acmeDirectoryCA string
+var acmeEmail string
+var acmeDomains string
+var tlsClientCA string
+var tlsClientAuth string = string(clientauth.None)
+var tlsClientAuthUpload string
+var httpRedirectPort int
+var requireSandbox bool
+var authFile string
+var authDefaultRoles string = string(auth.Download)
+var authAnonymousRoles string
+var pairingEnabled bool
+var pinRotate string = "0s"
+var pinQRCode bool
+var shareFile string
+var shareExpiry string = "24h"
+var shareMaxDownloads int
+var uploadRequestFolder string
+var uploadRequestExpiry string = "24h"
+var uploadRequestMaxSize int64
+var uploadRequestMaxFiles int
+var allowCIDRs ipfilter.Prefixes
+var denyCIDRs ipfilter.Prefixes
+var allowCIDRsUpload ipfilter.Prefixes
+var denyCIDRsUpload ipfilter.Prefixes
+var trustedProxies ipfilter.Prefixes
+var configFile string
+var printConfigAndExit bool
 
 //go:embed frontend/*
 var content embed.FS
@@ -60,70 +121,85 @@ func init() {
 	tlsCertPath = filepath.Join(baseDir, tlsCertPath)
 	tlsKeyPath = filepath.Join(baseDir, tlsKeyPath)
 
+	configDir = filepath.Join(baseDir, "."+name)
+	if userConfigDir, err := os.UserConfigDir(); err == nil {
+		configDir = filepath.Join(userConfigDir, name)
+	}
+
 	dataDir = filepath.Join(baseDir, "data")
 	uploadDir = filepath.Join(dataDir, "uploads")
 
 	flag.StringVar(&dataDir, "dataDir", dataDir, "directory to serve from")
 	flag.StringVar(&uploadDir, "uploadDir", uploadDir, "directory to upload to")
-	flag.StringVar(&listenAddress, "address", listenAddress, "address to listen on")
+	flag.StringVar(&uploadConflict, "upload-conflict", uploadConflict, fmt.Sprintf("what to do when an upload's name is taken: one of %v", upload.ConflictPolicies))
+	flag.UintVar(&uploadMaxDepth, "upload-max-depth", uploadMaxDepth, "most path segments an uploaded folder's files may have")
+	flag.StringVar(&uploadStaleAge, "upload-stale-age", uploadStaleAge, "remove staging files and resumable uploads left untouched this long, at startup and, for resumable ones, as the server runs")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", maxUploadSize, "largest single upload accepted, in bytes (0 for no limit)")
+	flag.Int64Var(&uploadQuota, "upload-quota", uploadQuota, "most bytes uploadDir may hold (0 for no limit)")
+	flag.Int64Var(&clientDailyQuota, "client-daily-quota", clientDailyQuota, "most bytes a single client IP may upload per day (0 for no limit)")
+	flag.Int64Var(&minFreeSpace, "min-free-space", minFreeSpace, "bytes which must remain free on the filesystem holding uploadDir")
+	flag.Var(&listenAddresses, "address", "address to listen on: an IP address, 0.0.0.0 or :: for every address, or a network interface's name (may be repeated)")
+	flag.Var(&listenSockets, "listen", "socket to listen on instead, as unix:/path.sock (may be repeated); like sockets passed by socket activation (LISTEN_FDS), it replaces listening on address unless that's given too")
 	flag.IntVar(&listenPort, "port", listenPort, "port to listen on")
+	flag.IntVar(&httpRedirectPort, "http-redirect-port", httpRedirectPort, "port to redirect plain HTTP requests to tls from, also serving the CA certificate and answering ACME HTTP-01 challenges (0 to disable)")
 	flag.BoolVar(&printQRCode, "qrcode", printQRCode, "print QRCode")
 	flag.BoolVar(&tlsEnabled, "tls", tlsEnabled, "host with tls")
 	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", tlsSelfSigned, "use self-signed cert/key combo")
-	flag.StringVar(&tlsCertPath, "tls-cert-path", tlsCertPath, "path for tls cert if tls-self-signed=false")
-	flag.StringVar(&tlsKeyPath, "tls-key-path", tlsKeyPath, "path for tls cert if tls-self-signed=false")
+	flag.StringVar(&tlsCertPath, "tls-cert-path", tlsCertPath, "path for tls cert if tls-self-signed=false, reloaded when it changes or on SIGHUP")
+	flag.StringVar(&tlsKeyPath, "tls-key-path", tlsKeyPath, "path for tls cert if tls-self-signed=false, reloaded when it changes or on SIGHUP")
+	flag.BoolVar(&requireSandbox, "require-sandbox", requireSandbox, "refuse to start if filesystem access can't be sandboxed (unveil on OpenBSD, Landlock on Linux)")
+	flag.StringVar(&tlsKeyType, "tls-key-type", tlsKeyType, fmt.Sprintf("key type for the certificate if tls-self-signed=true: one of %v", certs.KeyTypes))
+	flag.StringVar(&tlsValidity, "tls-validity", tlsValidity, "validity of the certificate if tls-self-signed=true")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", tlsClientCA, "PEM file with the CA certificates client certificates are verified against")
+	flag.StringVar(&tlsClientAuth, "tls-client-auth", tlsClientAuth, fmt.Sprintf("client certificate requirement for downloads (and uploads, unless tls-client-auth-upload is set): one of %v", clientauth.Modes))
+	flag.StringVar(&tlsClientAuthUpload, "tls-client-auth-upload", tlsClientAuthUpload, "client certificate requirement for uploads, if different from tls-client-auth")
+	flag.StringVar(&authFile, "auth-file", authFile, "htpasswd file (bcrypt or SHA-crypt hashes) of users who may log in, each optionally followed by \":roles\"; when set, requests need the role of the routes they're for")
+	flag.StringVar(&authDefaultRoles, "auth-default-roles", authDefaultRoles, fmt.Sprintf("comma separated roles of users listed in auth-file without any, from %v", auth.Roles))
+	flag.StringVar(&authAnonymousRoles, "auth-anonymous-roles", authAnonymousRoles, "comma separated roles of requests without credentials, if auth-file is set")
+	flag.BoolVar(&pairingEnabled, "pin", pairingEnabled, "print a PIN at startup which browsers must enter once, getting a session cookie, before anything else")
+	flag.StringVar(&pinRotate, "pin-rotate", pinRotate, "replace the PIN this often, keeping browsers already paired (0 to never)")
+	flag.BoolVar(&pinQRCode, "pin-qrcode", pinQRCode, "bake the PIN into the QR codes' links, pairing whoever scans one")
+	flag.StringVar(&shareFile, "share", shareFile, "print a link to this file in dataDir, which needs no other access, and exit; admins may also POST path, expiry and max-downloads to "+shareMintPath)
+	flag.StringVar(&shareExpiry, "share-expiry", shareExpiry, "how long share links are valid for")
+	flag.IntVar(&shareMaxDownloads, "share-max-downloads", shareMaxDownloads, "how many times a share link may be used (0 for no limit)")
+	flag.StringVar(&uploadRequestFolder, "upload-request", uploadRequestFolder, "print a link letting whoever has it upload into this folder of uploadDir, without any other access, and exit; admins may also POST folder, expiry, max-size and max-files to "+requestMintPath)
+	flag.StringVar(&uploadRequestExpiry, "upload-request-expiry", uploadRequestExpiry, "how long upload request links are valid for")
+	flag.Int64Var(&uploadRequestMaxSize, "upload-request-max-size", uploadRequestMaxSize, "most bytes an upload request link may upload in all (0 for no limit)")
+	flag.IntVar(&uploadRequestMaxFiles, "upload-request-max-files", uploadRequestMaxFiles, "most files an upload request link may upload (0 for no limit)")
+	flag.Var(&allowCIDRs, "allow-cidr", "only admit downloads (and uploads, unless allow-cidr-upload is set) from this CIDR prefix or IP address (may be repeated)")
+	flag.Var(&denyCIDRs, "deny-cidr", "refuse downloads (and uploads, unless deny-cidr-upload is set) from this CIDR prefix or IP address, even if allowed (may be repeated)")
+	flag.Var(&allowCIDRsUpload, "allow-cidr-upload", "only admit uploads from this CIDR prefix or IP address, instead of allow-cidr (may be repeated)")
+	flag.Var(&denyCIDRsUpload, "deny-cidr-upload", "refuse uploads from this CIDR prefix or IP address, instead of deny-cidr (may be repeated)")
+	flag.Var(&trustedProxies, "trusted-proxy", "CIDR prefix or IP address of a reverse proxy whose X-Forwarded-For header tells where requests come from, as do those over unix sockets once one is set (may be repeated)")
+	flag.StringVar(&configDir, "config-dir", configDir, "directory holding the local CA used if tls-self-signed=true, ACME accounts and certificates, and the key share and upload request links are signed with")
+	flag.StringVar(&acmeDomains, "acme-domains", acmeDomains, "comma separated domains to obtain certificates for from acme-directory, instead of using tls-self-signed or tls-cert-path (accepting the CA's terms of service)")
+	flag.StringVar(&acmeDirectory, "acme-directory", acmeDirectory, "ACME directory URL to obtain certificates from if acme-domains is set")
+	flag.StringVar(&acmeDirectoryCA, "acme-directory-ca", acmeDirectoryCA, "PEM file with the CA certificates to trust for acme-directory, e.g. a test server's (defaults to the system's)")
+	flag.StringVar(&acmeEmail, "acme-email", acmeEmail, "contact email for the ACME account")
 	flag.StringVar(&shutdownTimeout, "timeout", shutdownTimeout, "maximum time to wait for a clean shutdown")
-}
-
-func tlsConfigSelfSigned() (*tls.Config, error) {
-	now := time.Now()
-	template := &x509.Certificate{
-		SerialNumber: big.NewInt(now.Unix()),
-		Subject: pkix.Name{
-			CommonName:         fmt.Sprintf("%s.%s", name, domain),
-			Country:            []string{"Earth"},
-			Organization:       []string{"siliconvortex.com"},
-			OrganizationalUnit: []string{name},
-		},
-		NotBefore:             now,
-		NotAfter:              now.AddDate(0, 0, 7), // Valid for seven days
-		SubjectKeyId:          []byte(name),
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		KeyUsage: x509.KeyUsageKeyEncipherment |
-			x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-	}
-
-	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, fmt.Errorf("failed to genrate key: %w", err)
-	}
-
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, privKey.Public(), privKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create certificate: %w", err)
-	}
-
-	return &tls.Config{
-		ServerName: name,
-		Certificates: []tls.Certificate{
-			{
-				Certificate: [][]byte{certBytes},
-				PrivateKey:  privKey,
-			},
-		},
-	}, nil
+	flag.StringVar(&configFile, "config", configFile, "YAML file with settings named like these flags (default config.yaml in config-dir), which override it, as do "+envPrefix+"* environment variables (e.g. "+envName("upload-conflict")+")")
+	flag.BoolVar(&printConfigAndExit, "print-config", printConfigAndExit, "print the effective configuration, in the config file's format, and exit")
 }
 
 func main() {
 	flag.Parse()
+	if err := loadConfig(flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if printConfigAndExit {
+		if err := printConfig(os.Stdout, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
 
 	dataDir = filepath.Clean(dataDir)
 	uploadDir = filepath.Clean(uploadDir)
 
-	var err error
-	err = os.MkdirAll(dataDir, 0700)
+	err := os.MkdirAll(dataDir, 0700)
 	if err != nil {
 		log.Println(err)
 	}
@@ -132,61 +208,279 @@ func main() {
 		log.Println(err)
 	}
 
-	if err := unveil.Unveil(dataDir, uploadDir); err != nil {
+	listenAddrs, err := resolveAddresses(listenAddresses.values)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	parsedShutdownTimeout, err := time.ParseDuration(shutdownTimeout)
+	shares, err = share.Open(sharesDir())
 	if err != nil {
 		log.Fatal(err)
 	}
+	if shareFile != "" {
+		urls := serverURLs(listenAddrs)
+		if len(listenSockets) > 0 && !listenAddresses.explicit {
+			urls = nil
+		}
+		if err := printShareLink(urls); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if uploadRequestFolder != "" {
+		urls := serverURLs(listenAddrs)
+		if len(listenSockets) > 0 && !listenAddresses.explicit {
+			urls = nil
+		}
+		if err := printUploadRequest(urls); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	ipPortCombo := fmt.Sprintf("%s:%s", listenAddress, strconv.Itoa(listenPort))
-
+	// set up TLS before sandboxing, so the local CA's key never has to be
+	// reachable afterwards
 	scheme := "http"
 	srv := &http.Server{}
+	var keyPair *certs.KeyPair
+	var acmeManager *autocert.Manager
 
 	if tlsEnabled {
 		scheme = "https"
 
 		var tlsConfig *tls.Config
-		if tlsSelfSigned {
+		switch {
+		case acmeDomains != "":
+			tlsConfig, acmeManager, err = tlsConfigACME()
+		case tlsSelfSigned:
 			// the default http server with tlsConfig
-			tlsConfig, err = tlsConfigSelfSigned()
+			tlsConfig, err = tlsConfigSelfSigned(reachableHosts(listenAddrs))
+		default:
+			tlsConfig, keyPair, err = tlsConfigFromFiles()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		srv.TLSConfig = tlsConfig
+	}
+
+	downloadAuth, uploadAuth, err := clientAuthModes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if downloadAuth != clientauth.None || uploadAuth != clientauth.None {
+		if err := requestClientCerts(srv.TLSConfig, acmeManager != nil, downloadAuth, uploadAuth); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	downloadFilter, uploadFilter := ipFilters()
+
+	var pairer *pairing.Pairing
+	if pairingEnabled {
+		pairer, err = pairing.New()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var redirectSrv *http.Server
+	if httpRedirectPort != 0 {
+		redirectSrv = &http.Server{}
+	}
+
+	// open every listener before sandboxing too, so unix sockets can be
+	// created
+	socketLns, err := inheritedListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, spec := range listenSockets {
+		ln, err := listenSocket(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socketLns = append(socketLns, ln)
+	}
+	if len(socketLns) > 0 && !listenAddresses.explicit {
+		listenAddrs = nil
+	}
+
+	port := strconv.Itoa(listenPort)
+	lns := socketLns
+	var redirectLns []net.Listener
+	for _, a := range listenAddrs {
+		ln, err := net.Listen("tcp", net.JoinHostPort(a.Bind, port))
+		if err != nil {
+			log.Fatal(err)
+		}
+		lns = append(lns, ln)
+
+		if redirectSrv != nil {
+			ln, err := net.Listen("tcp", net.JoinHostPort(a.Bind, strconv.Itoa(httpRedirectPort)))
 			if err != nil {
 				log.Fatal(err)
 			}
+			redirectLns = append(redirectLns, ln)
 		}
+	}
+	if len(lns) == 0 {
+		log.Fatal("nothing to listen on")
+	}
 
-		srv.TLSConfig = tlsConfig
+	// warm up lazily loaded system files before they become unreachable
+	_ = mime.TypeByExtension(".html")
+	_, _ = time.Now().Zone()
+
+	policy := sandbox.Policy{
+		ReadOnly:     []string{dataDir},
+		ReadWrite:    []string{uploadDir, sharesDir()},
+		Capabilities: []sandbox.Capability{sandbox.Inet},
+	}
+	if len(socketLns) > 0 {
+		// unix sockets, or inherited ones which may be
+		policy.Capabilities = append(policy.Capabilities, sandbox.Unix)
+	}
+	if keyPair != nil {
+		policy.ReadOnly = append(policy.ReadOnly, keyPairDirs(tlsCertPath, tlsKeyPath)...)
+	}
+	if acmeManager != nil {
+		// certificates are obtained and renewed while serving
+		_, _ = x509.SystemCertPool()
+		cacheDir, _ := acmeCacheDir()
+		policy.ReadWrite = append(policy.ReadWrite, cacheDir)
+		policy.Capabilities = append(policy.Capabilities, sandbox.DNS)
 	}
 
-	theURL := url.URL{
-		Scheme: scheme,
-		Host:   ipPortCombo,
+	err = policy.Unveil()
+	if errors.Is(err, sandbox.ErrUnsupported) {
+		if requireSandbox {
+			log.Fatal(err)
+		}
+		log.Printf("WARNING: %v, continuing without a sandbox", err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	conflictPolicy, err := upload.ParseConflictPolicy(uploadConflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dataRoot, err := os.OpenRoot(dataDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploadRoot, err := os.OpenRoot(uploadDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store = upload.New(uploadRoot, conflictPolicy)
+	store.MaxDepth = uploadMaxDepth
+	limiter = upload.NewLimiter(uploadDir, upload.Limits{
+		MaxFileSize:      maxUploadSize,
+		Quota:            uploadQuota,
+		ClientDailyQuota: clientDailyQuota,
+		MinFreeSpace:     minFreeSpace,
+	})
+
+	parsedUploadStaleAge, err := time.ParseDuration(uploadStaleAge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	swept, err := store.Sweep(parsedUploadStaleAge)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, name := range swept {
+		log.Printf("removed stale upload: %s", filepath.Join(uploadDir, name))
+	}
+
+	parsedPINRotate, err := time.ParseDuration(pinRotate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parsedShutdownTimeout, err := time.ParseDuration(shutdownTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	urls := serverURLs(listenAddrs)
+	// redirects keep the host the client asked for...
+	redirectURL := url.URL{Scheme: scheme, Host: net.JoinHostPort("", port)}
+	if acmeManager != nil {
+		// ...unless the certificate is only valid for the domain names
+		redirectURL = urls[0]
+	}
+
+	requestLogger := middleware.RequestLogger(&identityLogFormatter{
+		DefaultLogFormatter: middleware.DefaultLogFormatter{Logger: log.New(os.Stdout, "", log.LstdFlags)},
+	})
+
+	if redirectSrv != nil {
+		redirectSrv.Handler = redirectRouter(redirectURL, acmeManager, downloadFilter, requestLogger)
 	}
 
 	idleConnsClosed := make(chan struct{})
 
-	// a go func to capture os.Interrupt and shutdown the server cleanly.
-	// this times out (and force termination connections) after parsedShutdownTimeout
+	// a go func to capture os.Interrupt or SIGTERM and shutdown the server
+	// cleanly, letting uploads in progress finish.  this times out (and force
+	// termination connections) after parsedShutdownTimeout
 	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt)
-		<-sigint
+		sigs := make(chan os.Signal, 2)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+
+		log.Printf("%v received, exiting nicely.  Signal again to force.", sig)
+		uploads.drain()
+		go func() {
+			<-sigs
+			log.Println("Forcing exit.")
+			uploads.logActive("Abandoning")
+			os.Exit(1)
+		}()
+
+		uploads.logActive("Waiting for")
+		go func() {
+			ticker := time.NewTicker(uploadReportInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					uploads.logActive("Waiting for")
+				case <-idleConnsClosed:
+					return
+				}
+			}
+		}()
 
-		log.Println("Exiting nicely.  Interrupt again to force.")
 		timeoutCtx, cancel := context.WithTimeout(context.Background(), parsedShutdownTimeout)
 		defer cancel()
+		if redirectSrv != nil {
+			if err := redirectSrv.Shutdown(timeoutCtx); err != nil {
+				log.Printf("HTTP redirect server Shutdown: %v", err)
+			}
+		}
 		if err := srv.Shutdown(timeoutCtx); err != nil {
 			log.Printf("HTTP server Shutdown: %v", err)
+			uploads.logActive("Abandoning")
+			_ = srv.Close()
 		}
 		close(idleConnsClosed)
 	}()
 
 	r := chi.NewRouter()
+	r.Use(ipfilter.TrustProxies(trustedProxies))
 	r.Use(middleware.RequestID)
-	r.Use(middleware.Logger)
+	r.Use(clientauth.Identify)
+	r.Use(authenticator.Authenticate)
+	r.Use(requestLogger)
 	r.Use(middleware.Recoverer)
 
 	fsys, err := fs.Sub(content, "frontend")
@@ -194,41 +488,265 @@ func main() {
 		log.Fatal(err)
 	}
 
-	FileServer(r, "/", http.FS(fsys))
-	FileServer(r, "/data", http.Dir(dataDir))
-	FileServer(r, "/uploads", http.Dir(uploadDir))
-	r.Post("/uploader/upload", uploadFile)
+	uploaderFS, err := fs.Sub(fsys, "uploader")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := uploadRoot.Mkdir(tusDirName, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		log.Fatal(err)
+	}
+	tusRoot, err := uploadRoot.OpenRoot(tusDirName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tusHandler := tus.New("/uploader/tus", tusRoot, finishTusUpload)
+	tusHandler.MaxSize = maxUploadSize
+	tusHandler.OnCreate = startTusUpload
+	tusHandler.OnDiscard = discardTusUpload
+	tusHandler.ErrorStatus = uploadErrorStatus
+	// the largest leftovers of a crash are resumable uploads
+	sweepTusUploads(tusHandler, parsedUploadStaleAge)
+	if parsedUploadStaleAge > 0 {
+		go expireTusUploads(tusHandler, parsedUploadStaleAge)
+	}
+
+	if pairer != nil {
+		r.With(downloadFilter.Enforce).Post(pairing.Path, pairer.ServeHTTP)
+	}
+	r.Group(func(r chi.Router) {
+		// what's needed before pairing or logging in, or instead of it
+		r.Use(clientauth.Enforce(downloadAuth))
+		r.Use(downloadFilter.Enforce)
+		if localCA != nil {
+			r.Get("/ca.crt", serveCACert)
+			r.Get("/ca.mobileconfig", serveCAMobileConfig)
+		}
+		// publicly trusted ACME certificates need no pinning
+		if tlsEnabled && acmeManager == nil {
+			r.Get("/tls/fingerprint", serveTLSFingerprint(srv.TLSConfig))
+		}
+		r.Get(sharePrefix+"{token}", serveShared(dataRoot))
+		r.Head(sharePrefix+"{token}", serveShared(dataRoot))
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(clientauth.Enforce(downloadAuth))
+		r.Use(downloadFilter.Enforce)
+		r.Use(pairer.Require)
+		r.Use(authenticator.Require(auth.Download))
+		FileServer(r, "/", http.FS(fsys))
+		FileServer(r, "/data", hiddenFileSystem{http.FS(dataRoot.FS())})
+		FileServer(r, "/uploads", hiddenFileSystem{http.FS(uploadRoot.FS())})
+	})
+	r.Group(func(r chi.Router) {
+		// the upload page is of use to those who may only upload, too
+		r.Use(clientauth.Enforce(uploadAuth))
+		r.Use(uploadFilter.Enforce)
+		r.Use(pairer.Require)
+		r.Use(authenticator.Require(auth.Upload, auth.Download))
+		FileServer(r, "/uploader", http.FS(uploaderFS))
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(clientauth.Enforce(uploadAuth))
+		r.Use(uploadFilter.Enforce)
+		r.Use(pairer.Require)
+		r.Use(authenticator.Require(auth.Upload))
+		r.Use(uploads.track)
+		r.Post("/uploader/upload", uploadFile)
+		r.Handle("/uploader/tus", tusHandler)
+		r.Handle("/uploader/tus/*", tusHandler)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(clientauth.Enforce(uploadAuth))
+		r.Use(uploadFilter.Enforce)
+		r.Use(pairer.Require)
+		r.Use(authenticator.Require(auth.Admin))
+		r.Post(shareMintPath, serveShareMint(dataRoot))
+		r.Post(requestMintPath, serveUploadRequestMint)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(clientauth.Enforce(uploadAuth))
+		r.Use(uploadFilter.Enforce)
+		r.Get(requestPrefix+"{token}", func(w http.ResponseWriter, r *http.Request) {
+			// the page's links are relative to the folder
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		})
+		r.Get(requestPrefix+"{token}/", serveUploadRequest)
+		r.Get(requestPrefix+"{token}/vendor/*", serveUploadRequestAssets(fsys))
+		r.With(uploads.track).Post(requestPrefix+"{token}/upload", uploadRequestFile)
+	})
 
 	log.Printf("Serving files from %s\n", dataDir)
 	log.Printf("Uploaded files stored in %s\n", uploadDir)
-	log.Printf("Listening at %s\n", theURL.String())
-	if printQRCode {
-		log.Printf("\n%s", getQRCode(theURL.String()))
+	var fragment string
+	// publicly trusted ACME certificates need no pinning, and may not have
+	// been obtained yet
+	if tlsEnabled && acmeManager == nil {
+		fingerprint := tlsFingerprint(srv.TLSConfig)
+		log.Printf("TLS certificate SHA-256 fingerprint: %s\n", formatFingerprint(fingerprint))
+
+		// browsers ignore the fragment, but a companion client can pin it
+		fragment = "sha256=" + hex.EncodeToString(fingerprint)
+	}
+	for _, ln := range socketLns {
+		log.Printf("Listening at %s:%s\n", ln.Addr().Network(), ln.Addr().String())
+	}
+	var pin string
+	if pairer != nil {
+		pin = pairer.PIN()
+	}
+	for _, u := range urls {
+		log.Printf("Listening at %s\n", u.String())
+		if printQRCode {
+			log.Printf("\n%s", getQRCode(qrCodeURL(u, fragment, pin)))
+		}
+	}
+	if pairer != nil {
+		log.Printf("Pairing PIN: %s\n", pin)
+		pairer.OnRotate = func(pin string) { printPIN(pin, urls, fragment) }
+		if parsedPINRotate > 0 {
+			go rotatePIN(pairer, parsedPINRotate)
+		}
 	}
 
-	// blocking call, running the server
-	srv.Addr = theURL.Host
 	srv.Handler = r
 
-	if tlsEnabled {
-		if tlsSelfSigned {
-			// server already as tlsConfig, so it will ignore the cert/key empty strings here
-			if err = srv.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-				log.Fatalf("HTTP server ListenAndServeTLS self-signed: %v", err)
-			}
-		} else {
-			if err = srv.ListenAndServeTLS(tlsCertPath, tlsKeyPath); err != http.ErrServerClosed {
-				log.Fatalf("HTTP server ListenAndServeTLS path: %v", err)
+	// the listeners are open and certificates are loaded, so drop everything
+	// else before serving a single request
+	if err := policy.Pledge(); err != nil {
+		log.Fatal(err)
+	}
+
+	if keyPair != nil {
+		go watchKeyPair(keyPair)
+	}
+
+	if len(redirectLns) > 0 {
+		log.Printf("Redirecting plain HTTP from port %d\n", httpRedirectPort)
+	}
+	for _, ln := range redirectLns {
+		go func() {
+			if err := redirectSrv.Serve(ln); err != http.ErrServerClosed {
+				log.Fatalf("HTTP redirect server Serve: %v", err)
 			}
+		}()
+	}
+
+	// every listener but the first is served in the background, the first
+	// one blocks
+	for _, ln := range lns[1:] {
+		go serve(srv, ln)
+	}
+	serve(srv, lns[0])
+
+	<-idleConnsClosed
+	log.Println("Done.")
+}
+
+// ipFilters returns the filters admitting downloads and uploads, nil for
+// those admitting everything.
+func ipFilters() (download, upload *ipfilter.Filter) {
+	if len(allowCIDRs) > 0 || len(denyCIDRs) > 0 {
+		download = &ipfilter.Filter{Allow: allowCIDRs, Deny: denyCIDRs}
+	}
+
+	allow, deny := allowCIDRs, denyCIDRs
+	if len(allowCIDRsUpload) > 0 {
+		allow = allowCIDRsUpload
+	}
+	if len(denyCIDRsUpload) > 0 {
+		deny = denyCIDRsUpload
+	}
+	if len(allow) > 0 || len(deny) > 0 {
+		upload = &ipfilter.Filter{Allow: allow, Deny: deny}
+	}
+
+	return download, upload
+}
+
+// serverURLs returns the URLs the server is reachable at on addrs.
+func serverURLs(addrs []listenAddr) []url.URL {
+	scheme := "http"
+	if tlsEnabled {
+		scheme = "https"
+	}
+	port := strconv.Itoa(listenPort)
+
+	if tlsEnabled && acmeDomains != "" {
+		// the certificate is only valid for the domain names
+		return []url.URL{{Scheme: scheme, Host: net.JoinHostPort(acmeDomainList()[0], port)}}
+	}
+
+	var urls []url.URL
+	for _, host := range reachableHosts(addrs) {
+		urls = append(urls, url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port)})
+	}
+
+	return urls
+}
+
+// serve runs srv on ln until it's shut down.
+func serve(srv *http.Server, ln net.Listener) {
+	if srv.TLSConfig != nil {
+		// server already has tlsConfig, so it will ignore the cert/key empty strings here
+		if err := srv.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+			log.Fatalf("HTTP server ServeTLS: %v", err)
 		}
 	} else {
-		if err = srv.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("HTTP server ListenAndServe: %v", err)
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatalf("HTTP server Serve: %v", err)
 		}
 	}
+}
 
-	<-idleConnsClosed
-	log.Println("Done.")
+// identityLogFormatter logs requests like middleware.DefaultLogFormatter,
+// adding the client's certificate identity and user name, if known, next to
+// the request ID.
+type identityLogFormatter struct {
+	middleware.DefaultLogFormatter
+}
+
+func (f *identityLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	ids := []string{middleware.GetReqID(r.Context())}
+	if id := clientauth.Identity(r.Context()); id != "" {
+		ids = append(ids, id)
+	}
+	if user := auth.FromContext(r.Context()).Name; user != "" {
+		ids = append(ids, user)
+	}
+
+	if len(ids) > 1 {
+		reqID := strings.TrimSpace(strings.Join(ids, " "))
+		r = r.WithContext(context.WithValue(r.Context(), middleware.RequestIDKey, reqID))
+	}
+
+	return f.DefaultLogFormatter.NewLogEntry(r)
+}
+
+// newAuthenticator loads the users in authFile, returning nil, letting
+// everyone do anything, if there is none.
+func newAuthenticator() (*auth.Authenticator, error) {
+	if authFile == "" {
+		return nil, nil
+	}
+
+	defaultRoles, err := auth.ParseRoles(authDefaultRoles)
+	if err != nil {
+		return nil, err
+	}
+	anonymousRoles, err := auth.ParseRoles(authAnonymousRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := auth.LoadHtpasswd(authFile, defaultRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.Authenticator{Users: users, Anonymous: anonymousRoles, Realm: name}, nil
 }
 
 type NotFoundRedirectRespWr struct {
@@ -250,48 +768,220 @@ func (w *NotFoundRedirectRespWr) Write(p []byte) (int, error) {
 	return len(p), nil // Lie that we successfully written it
 }
 
+// uploadFile streams every "file" part of a multipart request straight into
+// uploadDir.  Nothing is buffered in memory or spilled to temp files, which
+// keeps disk I/O down and works inside the unveiled directories.
 func uploadFile(w http.ResponseWriter, r *http.Request) {
-	//upload size
-	err := r.ParseMultipartForm(200000) // grab the multipart form
-	if err != nil {
+	receiveFiles(w, r, "")
+}
+
+// receiveFiles is uploadFile, storing the files in the folder of the upload
+// request token grants, if any, and counting them against its limits.
+func receiveFiles(w http.ResponseWriter, r *http.Request, token string) {
+	var folder string
+	if token != "" {
+		req, err := shares.CheckRequest(token)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(shareErrorStatus(err))
+			return
+		}
+		folder = req.Folder
+	}
+
+	client := ipfilter.ClientIP(r)
+	if err := limiter.Check(client, r.ContentLength); err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(uploadErrorStatus(err))
 		return
 	}
 
-	//reading original file
-	file, handler, err := r.FormFile("file")
+	mr, err := r.MultipartReader()
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	defer func() { _ = file.Close() }()
 
-	safeFileName, err := safepath.Clean(handler.Filename)
-	if err != nil {
-		log.Println(err)
+	var stored []string
+	var relativePath string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == "relativePath" {
+			// uppy sends its metadata ahead of the file it belongs to
+			b, err := io.ReadAll(io.LimitReader(part, 4096))
+			_ = part.Close()
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			relativePath = string(b)
+			continue
+		}
+
+		if part.FormName() != "file" || part.FileName() == "" {
+			// other form fields (e.g. uppy metadata) are of no interest
+			_ = part.Close()
+			continue
+		}
+
+		name := uploadName(relativePath, rawFileName(part))
+		limited := limiter.Reader(client, part)
+		var src io.Reader = limited
+		var incoming *share.Incoming
+		if folder != "" {
+			// the store validates the joined name, so the name sent can't
+			// lead out of the folder
+			name = folder + "/" + name
+			incoming, err = shares.Receive(token, src)
+			if err != nil {
+				limited.Done(false)
+				_ = part.Close()
+				log.Println(err)
+				w.WriteHeader(uploadErrorStatus(err))
+				return
+			}
+			src = incoming
+		}
+
+		name, err = store.Save(name, src)
+		relativePath = ""
+		_ = part.Close()
+		limited.Done(err == nil)
+		if incoming != nil {
+			if err := incoming.Done(err == nil); err != nil {
+				log.Println(err)
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(uploadErrorStatus(err))
+			return
+		}
+		log.Printf("uploaded: %s", filepath.Join(uploadDir, name))
+		stored = append(stored, strings.TrimPrefix(name, filepath.FromSlash(folder+"/")))
+	}
+
+	if len(stored) == 0 {
+		log.Println("upload request without any file parts")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	resFile, err := os.Create(filepath.Clean(filepath.Join(uploadDir, safeFileName)))
+	for _, name := range stored {
+		_, _ = fmt.Fprintf(w, "Successfully Uploaded Original File as %s\n", name)
+	}
+}
+
+// rawFileName returns the filename of a multipart file part as the client
+// sent it.  Unlike part.FileName, any directories are kept, which is how
+// browsers send the files of an uploaded folder.
+func rawFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+
+	return params["filename"]
+}
+
+// uploadName picks the name to store an upload under, preferring the path
+// relative to a folder the user uploaded.
+func uploadName(relativePath, fileName string) string {
+	// uppy stringifies a missing relativePath
+	if relativePath == "" || relativePath == "null" {
+		return fileName
+	}
+
+	return relativePath
+}
+
+// startTusUpload checks a new resumable upload against the upload limits,
+// charging all of it to the client, and the upload quota, up front.
+func startTusUpload(r *http.Request, info tus.Info) error {
+	if err := limiter.Check(info.Client, info.Size); err != nil {
+		return err
+	}
+
+	limiter.Charge(info.Client, info.Size)
+	return nil
+}
+
+// discardTusUpload refunds what startTusUpload charged for a resumable
+// upload which won't complete.
+func discardTusUpload(info tus.Info) {
+	limiter.Refund(info.Client, info.Size)
+}
+
+// expireTusUploads removes resumable uploads left untouched for maxAge,
+// checking every maxAge.
+func expireTusUploads(h *tus.Handler, maxAge time.Duration) {
+	ticker := time.NewTicker(maxAge)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepTusUploads(h, maxAge)
+	}
+}
+
+// sweepTusUploads removes resumable uploads left untouched for maxAge.
+func sweepTusUploads(h *tus.Handler, maxAge time.Duration) {
+	expired, err := h.Sweep(maxAge)
 	if err != nil {
 		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
 	}
-	defer func() { _ = resFile.Close() }()
+	for _, id := range expired {
+		log.Printf("removed stale resumable upload: %s", id)
+	}
+}
 
-	if err == nil {
-		_, err := io.Copy(resFile, file)
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		log.Printf("uploaded: %s", resFile.Name())
-		_, _ = fmt.Fprintf(w, "Successfully Uploaded Original File\n")
+// finishTusUpload moves a completed resumable upload into uploadDir, named
+// after the filename the client sent in its Upload-Metadata.
+func finishTusUpload(info tus.Info, dataName string) error {
+	fileName := info.Metadata["filename"]
+	if fileName == "" {
+		fileName = info.Metadata["name"]
+	}
+
+	name, err := store.Move(uploadName(info.Metadata["relativePath"], fileName), filepath.Join(tusDirName, dataName))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("uploaded: %s", filepath.Join(uploadDir, name))
+	return nil
+}
+
+// uploadErrorStatus maps an error from storing an upload to the HTTP status
+// reported to the client.
+func uploadErrorStatus(err error) int {
+	var badName upload.BadNameErr
+	var conflict upload.ConflictErr
+	var tooLarge upload.TooLargeErr
+	var insufficientStorage upload.InsufficientStorageErr
+	switch {
+	case errors.As(err, &badName):
+		return http.StatusBadRequest
+	case errors.As(err, &conflict):
+		return http.StatusConflict
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &insufficientStorage):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, share.ErrExhausted):
+		// an upload request's limits were reached by this upload
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
 	}
 }
 
@@ -312,6 +1002,38 @@ func getLocalIP() string {
 	return ""
 }
 
+// qrCodeURL returns what a QR code for u links to: u with the TLS
+// certificate's fingerprint, and the pairing PIN if it's to be baked in.
+func qrCodeURL(u url.URL, fragment, pin string) string {
+	u.Fragment = fragment
+	if pin != "" && pinQRCode {
+		u.RawQuery = url.Values{pairing.PINParam: {pin}}.Encode()
+	}
+
+	return u.String()
+}
+
+// rotatePIN replaces pairer's PIN every interval.
+func rotatePIN(pairer *pairing.Pairing, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := pairer.Rotate(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// printPIN prints a new pairing PIN, and new QR codes if they carry it.
+func printPIN(pin string, urls []url.URL, fragment string) {
+	if printQRCode && pinQRCode {
+		for _, u := range urls {
+			log.Printf("\n%s", getQRCode(qrCodeURL(u, fragment, pin)))
+		}
+	}
+	log.Printf("Pairing PIN: %s\n", pin)
+}
+
 func getQRCode(s string) string {
 	q, err := qrcode.New(s, qrcode.Low)
 	if err != nil {
@@ -321,6 +1043,51 @@ func getQRCode(s string) string {
 	return q.ToString(false)
 }
 
+// hiddenFileSystem is a http.FileSystem which refuses to serve (or list)
+// dot files, keeping server bookkeeping such as partial uploads private.  It
+// wraps an os.Root backed filesystem, so symlinks out of the tree are refused
+// as well.
+type hiddenFileSystem struct {
+	http.FileSystem
+}
+
+func (h hiddenFileSystem) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	f, err := h.FileSystem.Open(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, fs.ErrPermission) {
+			// most likely an os.Root refusing to follow a symlink out of
+			// the served tree; don't let that surface as a server error
+			log.Println(err)
+			return nil, fs.ErrPermission
+		}
+		return nil, err
+	}
+
+	return hiddenFile{f}, nil
+}
+
+type hiddenFile struct {
+	http.File
+}
+
+func (f hiddenFile) Readdir(n int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	visible := entries[:0]
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") {
+			visible = append(visible, e)
+		}
+	}
+
+	return visible, err
+}
+
 // FileServer conveniently sets up a http.FileServer handler to serve
 // static files from a http.FileSystem.
 func FileServer(r chi.Router, path string, root http.FileSystem) {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+	"github.com/stensonb/fileserver/pkg/upload"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileServerRefusesEscapes(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ok.txt"), []byte("ok"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, tusDirName), 0700))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(dir, "secret.txt")))
+	require.NoError(t, os.Symlink(filepath.Join("..", filepath.Base(outside), "secret.txt"), filepath.Join(dir, "relative.txt")))
+	require.NoError(t, os.Symlink("ok.txt", filepath.Join(dir, "inside.txt")))
+
+	root, err := os.OpenRoot(dir)
+	require.NoError(t, err)
+	defer func() { _ = root.Close() }()
+
+	r := chi.NewRouter()
+	FileServer(r, "/data", hiddenFileSystem{http.FS(root.FS())})
+
+	cases := map[string]int{
+		"/data/ok.txt":            http.StatusOK,
+		"/data/inside.txt":        http.StatusOK,
+		"/data/escape/secret.txt": http.StatusForbidden,
+		"/data/secret.txt":        http.StatusForbidden,
+		"/data/relative.txt":      http.StatusForbidden,
+		"/data/../ok.txt":         http.StatusOK,
+		"/data/.tus/":             http.StatusNotFound,
+	}
+
+	for path, status := range cases {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		require.Equal(t, status, rec.Code, path)
+		require.NotContains(t, rec.Body.String(), "secret", path)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/data/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), tusDirName)
+}
+
+func TestQRCodeURL(t *testing.T) {
+	u := url.URL{Scheme: "https", Host: "192.0.2.1:1234"}
+
+	pinQRCode = false
+	require.Equal(t, "https://192.0.2.1:1234#sha256=ab", qrCodeURL(u, "sha256=ab", "123456"))
+
+	pinQRCode = true
+	defer func() { pinQRCode = false }()
+	require.Equal(t, "https://192.0.2.1:1234?pin=123456#sha256=ab", qrCodeURL(u, "sha256=ab", "123456"))
+	require.Equal(t, "https://192.0.2.1:1234", qrCodeURL(u, "", ""))
+}
+
+func TestIPFilters(t *testing.T) {
+	old := [][]netip.Prefix{allowCIDRs, denyCIDRs, allowCIDRsUpload, denyCIDRsUpload}
+	t.Cleanup(func() {
+		allowCIDRs, denyCIDRs, allowCIDRsUpload, denyCIDRsUpload = old[0], old[1], old[2], old[3]
+	})
+
+	allowCIDRs, denyCIDRs, allowCIDRsUpload, denyCIDRsUpload = nil, nil, nil, nil
+	download, upload := ipFilters()
+	require.Nil(t, download)
+	require.Nil(t, upload)
+
+	require.NoError(t, allowCIDRs.Set("192.168.1.0/24"))
+	require.NoError(t, denyCIDRsUpload.Set("192.168.1.66"))
+	download, upload = ipFilters()
+	require.Equal(t, &ipfilter.Filter{Allow: allowCIDRs}, download)
+	require.Equal(t, &ipfilter.Filter{Allow: allowCIDRs, Deny: denyCIDRsUpload}, upload)
+	require.True(t, download.Allowed(netip.MustParseAddr("192.168.1.66")))
+	require.False(t, upload.Allowed(netip.MustParseAddr("192.168.1.66")))
+}
+
+// setUpUploads points the upload globals at a fresh directory with limits,
+// returning it.
+func setUpUploads(t *testing.T, limits upload.Limits) string {
+	t.Helper()
+	oldUploadDir, oldStore, oldLimiter := uploadDir, store, limiter
+	t.Cleanup(func() { uploadDir, store, limiter = oldUploadDir, oldStore, oldLimiter })
+
+	uploadDir = t.TempDir()
+	root, err := os.OpenRoot(uploadDir)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = root.Close() })
+
+	store = upload.New(root, upload.Overwrite)
+	limiter = upload.NewLimiter(uploadDir, limits)
+
+	return uploadDir
+}
+
+// multipartBody writes files, by name, as "file" parts, each preceded by
+// its relativePath if it's in a folder.
+func multipartBody(t *testing.T, files map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		if strings.Contains(name, "/") {
+			require.NoError(t, mw.WriteField("relativePath", name))
+		}
+		fw, err := mw.CreateFormFile("file", path.Base(name))
+		require.NoError(t, err)
+		_, err = io.WriteString(fw, content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+
+	return &body, mw.FormDataContentType()
+}
+
+func TestUploadFile(t *testing.T) {
+	dir := setUpUploads(t, upload.Limits{})
+
+	files := map[string]string{"a.txt": "first", "b.txt": "second", "docs/c.txt": "third"}
+	body, contentType := multipartBody(t, files)
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	uploadFile(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	for name, content := range files {
+		require.Contains(t, rec.Body.String(), filepath.FromSlash(name))
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		require.Equal(t, content, string(b))
+	}
+
+	// a request without any file parts
+	body, contentType = multipartBody(t, nil)
+	req = httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec = httptest.NewRecorder()
+	uploadFile(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestUploadFileTooLarge(t *testing.T) {
+	dir := setUpUploads(t, upload.Limits{MaxFileSize: 4})
+
+	body, contentType := multipartBody(t, map[string]string{"big.txt": "more than four bytes"})
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	uploadFile(rec, req)
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestUploadFileClientDisconnects(t *testing.T) {
+	dir := setUpUploads(t, upload.Limits{})
+
+	pr, pw := io.Pipe()
+	defer func() { _ = pr.Close() }()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("file", "partial.txt")
+		if err == nil {
+			_, err = io.WriteString(fw, strings.Repeat("x", 64<<10))
+		}
+		// the client goes away halfway through the file
+		if err == nil {
+			_ = pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", pr)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadFile(rec, req)
+
+	require.NotEqual(t, http.StatusOK, rec.Code)
+	// neither the partial file nor its staging file is left behind
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by socket activation,
+// following stdin, stdout and stderr.
+const listenFDsStart = 3
+
+// addressFlag collects repeated -address flags, replacing the default with
+// the first one given.
+type addressFlag struct {
+	values   []string
+	explicit bool
+}
+
+var _ flag.Value = &addressFlag{}
+
+func (a *addressFlag) String() string {
+	return strings.Join(a.values, ",")
+}
+
+func (a *addressFlag) Values() []string {
+	return a.values
+}
+
+func (a *addressFlag) Set(value string) error {
+	if !a.explicit {
+		a.values = nil
+		a.explicit = true
+	}
+	a.values = append(a.values, value)
+
+	return nil
+}
+
+// listenFlag collects repeated -listen flags.
+type listenFlag []string
+
+var _ flag.Value = &listenFlag{}
+
+func (l *listenFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlag) Values() []string {
+	return *l
+}
+
+func (l *listenFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// listenSocket listens on a -listen flag's socket, "unix:/path.sock".
+func listenSocket(spec string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(spec, "unix:")
+	if !ok || path == "" {
+		return nil, fmt.Errorf("unsupported listener %q (want unix:/path.sock)", spec)
+	}
+
+	// a socket left behind by a previous run would make listening fail, but
+	// one still in use mustn't be taken over
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// inheritedListeners returns the sockets passed by systemd style socket
+// activation, described by the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+// environment variables.
+func inheritedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	// they're not meant for any process started later on
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(v)
+	}
+
+	return fileListeners(listenFDsStart, n, names)
+}
+
+// fileListeners turns n file descriptors, starting at first, into
+// listeners.
+func fileListeners(first uintptr, n int, names []string) ([]net.Listener, error) {
+	var lns []net.Listener
+	for i := range n {
+		name := fmt.Sprintf("fd %d", first+uintptr(i))
+		if i < len(names) {
+			name = names[i]
+		}
+
+		f := os.NewFile(first+uintptr(i), name)
+		// the listener has a duplicate of the descriptor
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %s: %w", name, err)
+		}
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+// listenAddr is an address to listen on, along with the addresses clients
+// may reach it by.
+type listenAddr struct {
+	Bind  string
+	Hosts []string
+}
+
+// resolveAddress interprets an -address flag: an IP address, a wildcard
+// ("0.0.0.0" for every IPv4 address, "::" or "" for every address), or the
+// name of a network interface, standing for each of its addresses.
+func resolveAddress(spec string) ([]listenAddr, error) {
+	if ip := net.ParseIP(spec); ip != nil && !ip.IsUnspecified() {
+		return []listenAddr{{Bind: spec, Hosts: []string{spec}}}, nil
+	}
+
+	if spec == "" || spec == "0.0.0.0" || spec == "::" {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+
+		ips := reachableIPs(addrs, spec == "0.0.0.0")
+		return []listenAddr{{Bind: spec, Hosts: ips}}, nil
+	}
+
+	iface, err := net.InterfaceByName(spec)
+	if err != nil {
+		return nil, fmt.Errorf("address %q is neither an IP address nor a network interface: %w", spec, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var listenAddrs []listenAddr
+	for _, ip := range reachableIPs(addrs, false) {
+		listenAddrs = append(listenAddrs, listenAddr{Bind: ip, Hosts: []string{ip}})
+	}
+	if len(listenAddrs) == 0 {
+		return nil, fmt.Errorf("network interface %s has no usable addresses", spec)
+	}
+
+	return listenAddrs, nil
+}
+
+// reachableIPs lists the addresses other machines may connect to, leaving
+// out loopback addresses, unless there are no others, and IPv6 link-local
+// ones, which need a zone browsers don't understand.
+func reachableIPs(addrs []net.Addr, ipv4Only bool) []string {
+	var ips, loopback []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipnet.IP
+		switch {
+		case ipv4Only && ip.To4() == nil:
+		case ip.To4() == nil && ip.IsLinkLocalUnicast():
+		case ip.IsLoopback():
+			loopback = append(loopback, ip.String())
+		default:
+			ips = append(ips, ip.String())
+		}
+	}
+
+	if len(ips) == 0 {
+		return loopback
+	}
+
+	return ips
+}
+
+// resolveAddresses resolves every -address flag.
+func resolveAddresses(specs []string) ([]listenAddr, error) {
+	var listenAddrs []listenAddr
+	for _, spec := range specs {
+		resolved, err := resolveAddress(spec)
+		if err != nil {
+			return nil, err
+		}
+		listenAddrs = append(listenAddrs, resolved...)
+	}
+
+	return listenAddrs, nil
+}
+
+// reachableHosts lists every address clients may reach any of listenAddrs
+// by, in the order given.
+func reachableHosts(listenAddrs []listenAddr) []string {
+	var hosts []string
+	for _, a := range listenAddrs {
+		for _, h := range a.Hosts {
+			if !slices.Contains(hosts, h) {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+
+	return hosts
+}
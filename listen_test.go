@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressFlag(t *testing.T) {
+	a := addressFlag{values: []string{"192.168.1.10"}}
+	require.Equal(t, "192.168.1.10", a.String())
+
+	// the default is replaced, not added to
+	require.NoError(t, a.Set("10.0.0.1"))
+	require.NoError(t, a.Set("::1"))
+	require.Equal(t, []string{"10.0.0.1", "::1"}, a.values)
+}
+
+func TestResolveAddress(t *testing.T) {
+	resolved, err := resolveAddress("192.168.1.10")
+	require.NoError(t, err)
+	require.Equal(t, []listenAddr{{Bind: "192.168.1.10", Hosts: []string{"192.168.1.10"}}}, resolved)
+
+	resolved, err = resolveAddress("0.0.0.0")
+	require.NoError(t, err)
+	require.Len(t, resolved, 1)
+	require.Equal(t, "0.0.0.0", resolved[0].Bind)
+	require.NotEmpty(t, resolved[0].Hosts)
+	for _, h := range resolved[0].Hosts {
+		require.NotNil(t, net.ParseIP(h).To4(), h)
+	}
+
+	_, err = resolveAddress("no-such-interface0")
+	require.Error(t, err)
+
+	interfaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+
+		resolved, err = resolveAddress(iface.Name)
+		require.NoError(t, err)
+		require.Contains(t, reachableHosts(resolved), "127.0.0.1")
+	}
+}
+
+func TestReachableIPs(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1")},
+		&net.IPNet{IP: net.ParseIP("192.168.1.10")},
+		&net.IPNet{IP: net.ParseIP("fe80::1")},
+		&net.IPNet{IP: net.ParseIP("2001:db8::1")},
+	}
+
+	require.Equal(t, []string{"192.168.1.10", "2001:db8::1"}, reachableIPs(addrs, false))
+	require.Equal(t, []string{"192.168.1.10"}, reachableIPs(addrs, true))
+
+	// loopback addresses are better than nothing
+	require.Equal(t, []string{"127.0.0.1"}, reachableIPs(addrs[:1], false))
+}
+
+func TestListenSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fileserver.sock")
+
+	ln, err := listenSocket("unix:" + path)
+	require.NoError(t, err)
+
+	// a socket in use isn't taken over...
+	_, err = listenSocket("unix:" + path)
+	require.Error(t, err)
+
+	// ...but a stale one is replaced
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, ln.Close())
+	ln, err = listenSocket("unix:" + path)
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+
+	_, err = listenSocket("tcp:127.0.0.1:80")
+	require.Error(t, err)
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileListeners(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = tcpLn.Close() }()
+
+	f, err := tcpLn.(*net.TCPListener).File()
+	require.NoError(t, err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	lns, err := fileListeners(uintptr(fd), 1, []string{"http"})
+	require.NoError(t, err)
+	require.Len(t, lns, 1)
+	defer func() { _ = lns[0].Close() }()
+	require.Equal(t, tcpLn.Addr().String(), lns[0].Addr().String())
+}
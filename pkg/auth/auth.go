@@ -0,0 +1,134 @@
+// Package auth authenticates users with HTTP Basic authentication against an
+// htpasswd file, and lets routes require a role.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type Role string
+
+const (
+	// Download allows browsing and downloading files.
+	Download Role = "download"
+	// Upload allows uploading files.
+	Upload Role = "upload"
+	// Admin allows everything.
+	Admin Role = "admin"
+)
+
+// Roles lists every role.
+var Roles = []Role{Download, Upload, Admin}
+
+// ParseRoles parses a comma separated list of roles.
+func ParseRoles(s string) ([]Role, error) {
+	var roles []Role
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !slices.Contains(Roles, Role(r)) {
+			return nil, fmt.Errorf("unknown role %q (want some of %v)", r, Roles)
+		}
+		roles = append(roles, Role(r))
+	}
+
+	return roles, nil
+}
+
+// User is who made a request.
+type User struct {
+	// Name is empty for anonymous requests.
+	Name  string
+	Roles []Role
+}
+
+// Has reports whether the user may do what role allows.
+func (u User) Has(role Role) bool {
+	return slices.Contains(u.Roles, role) || slices.Contains(u.Roles, Admin)
+}
+
+type contextKey struct{}
+
+// FromContext returns the user Authenticator.Authenticate found.
+func FromContext(ctx context.Context) User {
+	u, _ := ctx.Value(contextKey{}).(User)
+	return u
+}
+
+// Authenticator checks the credentials requests come with.  A nil
+// Authenticator lets everyone do anything.
+type Authenticator struct {
+	Users *Users
+	// Anonymous are the roles of requests without credentials.
+	Anonymous []Role
+	// Realm is shown by browsers when asking for credentials.
+	Realm string
+}
+
+// Authenticate is middleware identifying the user, if the request has
+// credentials, for FromContext to return.  Requests with wrong credentials
+// get no roles at all, so Require asks for them again.
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := User{Roles: a.Anonymous}
+		if name, password, ok := r.BasicAuth(); ok {
+			user = User{}
+			if roles, ok := a.Users.Authenticate(name, password); ok {
+				user = User{Name: name, Roles: roles}
+			} else {
+				log.Printf("authentication failed for user %q", name)
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, user)))
+	})
+}
+
+// Require returns middleware refusing requests whose user has none of
+// roles: anonymous ones are asked for credentials, others are forbidden.  It
+// relies on Authenticate having run first.
+func (a *Authenticator) Require(roles ...Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if a == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := FromContext(r.Context())
+			switch {
+			case slices.ContainsFunc(roles, user.Has):
+				next.ServeHTTP(w, r)
+			case user.Name == "":
+				a.challenge(w)
+			default:
+				http.Error(w, fmt.Sprintf("%s may not %s", user.Name, joinRoles(roles)), http.StatusForbidden)
+			}
+		})
+	}
+}
+
+// joinRoles lists roles for a message, e.g. "upload or download".
+func joinRoles(roles []Role) string {
+	names := make([]string, len(roles))
+	for i, role := range roles {
+		names[i] = string(role)
+	}
+
+	return strings.Join(names, " or ")
+}
+
+func (a *Authenticator) challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", a.Realm))
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
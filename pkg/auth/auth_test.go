@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte(
+		"reader:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n"+
+			"root:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5:admin\n"), 0600))
+	users, err := LoadHtpasswd(path, []Role{Download})
+	require.NoError(t, err)
+
+	var seen User
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromContext(r.Context())
+	})
+
+	cases := []struct {
+		anonymous      []Role
+		role           Role
+		user, password string
+		status         int
+	}{
+		{nil, Download, "", "", http.StatusUnauthorized},
+		{[]Role{Download}, Download, "", "", http.StatusOK},
+		{[]Role{Download}, Upload, "", "", http.StatusUnauthorized},
+		{nil, Download, "reader", "Hello world!", http.StatusOK},
+		{nil, Download, "reader", "wrong", http.StatusUnauthorized},
+		{[]Role{Download}, Download, "reader", "wrong", http.StatusUnauthorized},
+		{nil, Upload, "reader", "Hello world!", http.StatusForbidden},
+		{nil, Upload, "root", "Hello world!", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		a := &Authenticator{Users: users, Anonymous: c.anonymous, Realm: "test"}
+		seen = User{}
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		rec := httptest.NewRecorder()
+		a.Authenticate(a.Require(c.role)(ok)).ServeHTTP(rec, req)
+
+		require.Equal(t, c.status, rec.Code, c)
+		if c.status == http.StatusOK {
+			require.Equal(t, c.user, seen.Name)
+		}
+		if c.status == http.StatusUnauthorized {
+			require.Contains(t, rec.Header().Get("WWW-Authenticate"), `Basic realm="test"`)
+		}
+	}
+
+	// any of several roles will do
+	a := &Authenticator{Users: users, Anonymous: []Role{Upload}, Realm: "test"}
+	rec := httptest.NewRecorder()
+	a.Authenticate(a.Require(Download, Upload)(ok)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// and a user with none of them is told which
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("reader", "Hello world!")
+	a.Authenticate(a.Require(Upload, Admin)(ok)).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), "reader may not upload or admin")
+
+	// without an Authenticator, everything is allowed
+	a = nil
+	rec = httptest.NewRecorder()
+	a.Authenticate(a.Require(Admin)(ok)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles("download, upload,")
+	require.NoError(t, err)
+	require.Equal(t, []Role{Download, Upload}, roles)
+
+	_, err = ParseRoles("download,write")
+	require.Error(t, err)
+}
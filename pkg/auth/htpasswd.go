@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users are the accounts in an htpasswd file.
+type Users struct {
+	users map[string]account
+	// dummy is a hash unknown users' passwords are checked against, so
+	// they take as long to refuse as known ones and can't be told apart
+	dummy string
+
+	mu sync.Mutex
+	// verified remembers a digest of each user's last correct password,
+	// since browsers send it with every request and bcrypt is slow on
+	// purpose
+	verified map[string][sha256.Size]byte
+}
+
+type account struct {
+	hash  string
+	roles []Role
+}
+
+// LoadHtpasswd reads an htpasswd file, with "user:hash" lines as written by
+// Apache's htpasswd -B (bcrypt) or `openssl passwd -5` and `-6` (SHA-crypt).
+// A third field may list the user's roles, comma separated, e.g.
+// "alice:$2y$...:download,upload"; users without one get defaultRoles.
+func LoadHtpasswd(path string, defaultRoles []Role) (*Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	u := &Users{users: make(map[string]account), verified: make(map[string][sha256.Size]byte)}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("%s:%d: want user:hash or user:hash:roles", path, lineNo)
+		}
+		if !supportedHash(fields[1]) {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s, use bcrypt or SHA-crypt", path, lineNo, fields[0])
+		}
+
+		roles := defaultRoles
+		if len(fields) == 3 {
+			roles, err = ParseRoles(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+		}
+
+		u.users[fields[0]] = account{hash: fields[1], roles: roles}
+		if u.dummy == "" {
+			// as costly to check as the file's own hashes
+			u.dummy = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate returns the user's roles if password is theirs.
+func (u *Users) Authenticate(name, password string) ([]Role, bool) {
+	a, ok := u.users[name]
+	if !ok {
+		if u.dummy != "" {
+			verify(u.dummy, password)
+		}
+		return nil, false
+	}
+
+	digest := sha256.Sum256([]byte(name + ":" + password))
+	u.mu.Lock()
+	last, seen := u.verified[name]
+	u.mu.Unlock()
+	if seen && subtle.ConstantTimeCompare(last[:], digest[:]) == 1 {
+		return a.roles, true
+	}
+
+	if !verify(a.hash, password) {
+		return nil, false
+	}
+
+	u.mu.Lock()
+	u.verified[name] = digest
+	u.mu.Unlock()
+
+	return a.roles, true
+}
+
+func verify(hash, password string) bool {
+	if strings.HasPrefix(hash, "$5$") || strings.HasPrefix(hash, "$6$") {
+		computed, err := shaCrypt(hash, password)
+		return err == nil && subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
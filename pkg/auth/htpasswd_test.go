@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSHACrypt(t *testing.T) {
+	// produced by openssl passwd -5 / -6
+	cases := []struct{ password, hash string }{
+		{"Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"pässwörd", "$6$rounds=1000$abc$WawrB1RkOa7.MIVKsLHykkp4G3s2O9P9zSvyN8fgtHYKweYgvZleNrdrGfGTdL6wnjBeaUDvpZu3X.O1UrJb6/"},
+		{"a much longer password, longer than the sha-512 digest is, so that it wraps around", "$6$abcdefghijklmnop$P9ZhMimGpiC4NMSW/yCMlGDfwUZnQIt2n6qlInFHvEnv7a5xD9SX.KeimDFNE9DNq3TLnyomDmLMMF6EbPATZ0"},
+	}
+
+	for _, c := range cases {
+		got, err := shaCrypt(c.hash, c.password)
+		require.NoError(t, err)
+		require.Equal(t, c.hash, got)
+		require.True(t, verify(c.hash, c.password))
+		require.False(t, verify(c.hash, c.password+"!"))
+	}
+
+	// a salt longer than 16 characters is cut short
+	got, err := shaCrypt("$5$rounds=10000$saltstringsaltstring", "Hello world!")
+	require.NoError(t, err)
+	require.Equal(t, cases[1].hash, got)
+}
+
+func TestLoadHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\n"+
+		"alice:"+string(bcryptHash)+"\n"+
+		"bob:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5:download,upload\n"+
+		"\n"+
+		"root:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1:admin\n"), 0600))
+
+	users, err := LoadHtpasswd(path, []Role{Download})
+	require.NoError(t, err)
+
+	cases := []struct {
+		name, password string
+		ok             bool
+		roles          []Role
+	}{
+		{"alice", "secret", true, []Role{Download}},
+		// the second time, the password is remembered
+		{"alice", "secret", true, []Role{Download}},
+		{"alice", "Secret", false, nil},
+		{"bob", "Hello world!", true, []Role{Download, Upload}},
+		{"root", "Hello world!", true, []Role{Admin}},
+		// unknown users are checked against one of the hashes all the same,
+		// and refused even if it matches
+		{"mallory", "secret", false, nil},
+	}
+	for _, c := range cases {
+		roles, ok := users.Authenticate(c.name, c.password)
+		require.Equal(t, c.ok, ok, c.name)
+		require.Equal(t, c.roles, roles, c.name)
+	}
+
+	for _, bad := range []string{
+		"alice",
+		"alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"alice:$apr1$abc$def",
+		"alice:$2y$05$abc:superuser",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(bad+"\n"), 0600))
+		_, err := LoadHtpasswd(path, nil)
+		require.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt, as specified by Ulrich Drepper in "Unix crypt using SHA-256
+// and SHA-512" and produced by e.g. `openssl passwd -5` and `-6`.
+
+const (
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLen    = 16
+)
+
+// the order in which each variant's digest bytes are encoded, three at a
+// time
+var (
+	sha256CryptOrder = [][]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+		{-1, 31, 30},
+	}
+	sha512CryptOrder = [][]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41}, {-1, -1, 63},
+	}
+)
+
+// shaCrypt hashes password with the settings ("$5$salt" or
+// "$6$rounds=n$salt", anything after the salt is ignored) of hashed.
+func shaCrypt(hashed, password string) (string, error) {
+	var newHash func() hash.Hash
+	var order [][]int
+	var prefix string
+	switch {
+	case strings.HasPrefix(hashed, "$5$"):
+		newHash, order, prefix = sha256.New, sha256CryptOrder, "$5$"
+	case strings.HasPrefix(hashed, "$6$"):
+		newHash, order, prefix = sha512.New, sha512CryptOrder, "$6$"
+	default:
+		return "", errors.New("not a SHA-crypt hash")
+	}
+
+	settings := strings.TrimPrefix(hashed, prefix)
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if r, rest, ok := strings.Cut(settings, "$"); ok && strings.HasPrefix(r, "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(r, "rounds="))
+		if err != nil {
+			return "", errors.New("invalid SHA-crypt rounds")
+		}
+		rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		customRounds = true
+		settings = rest
+	}
+
+	salt, _, _ := strings.Cut(settings, "$")
+	if len(salt) > shaCryptMaxSaltLen {
+		salt = salt[:shaCryptMaxSaltLen]
+	}
+
+	digest := shaCryptDigest(newHash, []byte(password), []byte(salt), rounds)
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	if customRounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt)
+	b.WriteByte('$')
+	for _, group := range order {
+		var w uint
+		n := 0
+		for _, i := range group {
+			w <<= 8
+			if i >= 0 {
+				w |= uint(digest[i])
+				n++
+			}
+		}
+		for range n + 1 {
+			b.WriteByte(shaCryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+
+	return b.String(), nil
+}
+
+func shaCryptDigest(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	h := newHash()
+	size := h.Size()
+
+	// digest B
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	// digest A
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeat(b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// byte sequences P and S
+	h.Reset()
+	for range password {
+		h.Write(password)
+	}
+	p := repeat(h.Sum(nil), len(password))
+
+	h.Reset()
+	for range 16 + int(a[0]) {
+		h.Write(salt)
+	}
+	s := repeat(h.Sum(nil), len(salt))
+
+	c := a
+	for i := range rounds {
+		h.Reset()
+		if i%2 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c[:size])
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i%2 != 0 {
+			h.Write(c[:size])
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	return c
+}
+
+// repeat returns b repeated, then cut, to n bytes.
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+
+	return out
+}
@@ -0,0 +1,287 @@
+// Package certs manages the local certificate authority used when serving
+// TLS without a certificate from elsewhere.  The CA is generated once and
+// persisted, so devices only have to be told to trust it once.
+package certs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caValidity = 10 * 365 * 24 * time.Hour
+)
+
+// CA is a certificate authority whose key lives on local disk.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// LoadOrCreateCA loads the CA persisted in dir, generating (and persisting)
+// a new one named after commonName if there is none yet.
+func LoadOrCreateCA(dir, commonName string) (*CA, error) {
+	ca, err := loadCA(dir)
+	if err == nil {
+		return ca, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ca, err = newCA(commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ca.save(dir); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+func loadCA(dir string) (*CA, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA from %s: %w", dir, err)
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("loading CA from %s: key can't sign", dir)
+	}
+
+	return &CA{Cert: pair.Leaf, Key: signer}, nil
+}
+
+func newCA(commonName string) (*CA, error) {
+	key, err := GenerateKey(ECDSA)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+func (ca *CA) save(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(ca.Key)
+	if err != nil {
+		return err
+	}
+
+	// the key goes first, so a crash can't leave a certificate behind whose
+	// key is lost
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, caKeyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, caCertFile), ca.CertPEM(), 0644)
+}
+
+// CertPEM returns the CA certificate, PEM encoded, for devices to trust.
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// LeafOptions describes a server certificate to issue.
+type LeafOptions struct {
+	CommonName string
+	// Hosts are the IP addresses and DNS names the certificate is valid
+	// for.
+	Hosts    []string
+	Validity time.Duration
+	KeyType  KeyType
+}
+
+// Issue creates a server certificate signed by the CA.
+func (ca *CA) Issue(opts LeafOptions) (tls.Certificate, error) {
+	key, err := GenerateKey(opts.KeyType)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: opts.CommonName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(opts.Validity),
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+	}
+	if _, isRSA := key.(*rsa.PrivateKey); isRSA {
+		// for TLS 1.2 key exchanges without (EC)DHE
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, h := range opts.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	return serial, nil
+}
+
+var mobileConfigTemplate = template.Must(template.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>` + caCertFile + `</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{.Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>{{.Identifier}}.root</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{.Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>{{.Identifier}}</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// MobileConfig returns an Apple configuration profile which installs the CA
+// as a trusted root.  identifier is a reverse-DNS name for the profile.
+func (ca *CA) MobileConfig(identifier string) ([]byte, error) {
+	// derived from the certificate, so reinstalling replaces the profile
+	sum := sha256.Sum256(ca.Cert.Raw)
+
+	var b bytes.Buffer
+	err := mobileConfigTemplate.Execute(&b, map[string]string{
+		"Cert":        base64.StdEncoding.EncodeToString(ca.Cert.Raw),
+		"Name":        xmlEscape(ca.Cert.Subject.CommonName),
+		"Identifier":  xmlEscape(identifier),
+		"CertUUID":    uuid(sum[:16]),
+		"ProfileUUID": uuid(sum[16:]),
+	})
+
+	return b.Bytes(), err
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// uuid formats 16 bytes as a (version 4 looking) UUID.
+func uuid(b []byte) string {
+	u := make([]byte, 16)
+	copy(u, b)
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,75 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCAIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateCA(dir, "test CA")
+	require.NoError(t, err)
+	require.True(t, ca.Cert.IsCA)
+
+	again, err := LoadOrCreateCA(dir, "ignored")
+	require.NoError(t, err)
+	require.Equal(t, ca.Cert.Raw, again.Cert.Raw)
+	require.Equal(t, "test CA", again.Cert.Subject.CommonName)
+}
+
+func TestIssue(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir(), "test CA")
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	for _, keyType := range KeyTypes {
+		t.Run(string(keyType), func(t *testing.T) {
+			cert, err := ca.Issue(LeafOptions{
+				CommonName: "fileserver",
+				Hosts:      []string{"192.168.1.10", "fe80::1", "laptop.local"},
+				Validity:   time.Hour,
+				KeyType:    keyType,
+			})
+			require.NoError(t, err)
+			require.False(t, cert.Leaf.IsCA)
+			require.WithinDuration(t, time.Now().Add(time.Hour), cert.Leaf.NotAfter, time.Minute)
+
+			for _, host := range []string{"192.168.1.10", "fe80::1", "laptop.local"} {
+				_, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+				require.NoError(t, err, host)
+			}
+
+			_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "other.local", Roots: roots})
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	for _, kt := range KeyTypes {
+		parsed, err := ParseKeyType(string(kt))
+		require.NoError(t, err)
+		require.Equal(t, kt, parsed)
+	}
+
+	_, err := ParseKeyType("dsa")
+	require.Error(t, err)
+}
+
+func TestMobileConfig(t *testing.T) {
+	ca, err := LoadOrCreateCA(t.TempDir(), "a <b> & c")
+	require.NoError(t, err)
+
+	profile, err := ca.MobileConfig("com.example.fileserver")
+	require.NoError(t, err)
+	require.Contains(t, string(profile), base64.StdEncoding.EncodeToString(ca.Cert.Raw))
+	require.Contains(t, string(profile), "a &lt;b&gt; &amp; c")
+	require.Contains(t, string(profile), "com.apple.security.root")
+}
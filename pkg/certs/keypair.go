@@ -0,0 +1,103 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPair is a certificate and key loaded from files which may be replaced
+// while the server runs, e.g. when they're renewed.
+type KeyPair struct {
+	CertPath string
+	KeyPath  string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	stamps [2]fileStamp
+}
+
+// fileStamp identifies a version of a file without reading it.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// LoadKeyPair loads the certificate and key from the given PEM files.
+func LoadKeyPair(certPath, keyPath string) (*KeyPair, error) {
+	p := &KeyPair{CertPath: certPath, KeyPath: keyPath}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Reload reads the files again.  The new pair is only used if it's valid,
+// otherwise the previous one stays in place.
+func (p *KeyPair) Reload() error {
+	// stat before reading, so a change while reading is picked up next time
+	stamps, err := p.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.CertPath, p.KeyPath)
+	if err == nil && time.Now().After(cert.Leaf.NotAfter) {
+		err = fmt.Errorf("certificate %s expired at %s", p.CertPath, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// remembered even if invalid, so the same files aren't retried
+	p.stamps = stamps
+	if err != nil {
+		return err
+	}
+	p.cert = &cert
+
+	return nil
+}
+
+// Changed reports whether either file was modified since it was last
+// read.
+func (p *KeyPair) Changed() bool {
+	stamps, err := p.stat()
+	if err != nil {
+		// mid-replacement, most likely; try again later
+		return false
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return stamps != p.stamps
+}
+
+func (p *KeyPair) stat() ([2]fileStamp, error) {
+	var stamps [2]fileStamp
+	for i, path := range []string{p.CertPath, p.KeyPath} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return stamps, err
+		}
+		stamps[i] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+	}
+
+	return stamps, nil
+}
+
+// Certificate returns the pair currently in use.
+func (p *KeyPair) Certificate() *tls.Certificate {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.cert
+}
+
+// GetCertificate is for use as tls.Config.GetCertificate.
+func (p *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return p.Certificate(), nil
+}
@@ -0,0 +1,65 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyPair(t *testing.T, ca *CA, certPath, keyPath string, validity time.Duration) tls.Certificate {
+	t.Helper()
+
+	cert, err := ca.Issue(LeafOptions{CommonName: "test", Hosts: []string{"localhost"}, Validity: validity, KeyType: ECDSA})
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+
+	return cert
+}
+
+func TestKeyPairReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key")
+
+	ca, err := LoadOrCreateCA(dir, "test CA")
+	require.NoError(t, err)
+
+	first := writeKeyPair(t, ca, certPath, keyPath, time.Hour)
+	p, err := LoadKeyPair(certPath, keyPath)
+	require.NoError(t, err)
+	require.False(t, p.Changed())
+
+	got, err := p.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, first.Leaf.Raw, got.Leaf.Raw)
+
+	// an expired certificate is refused, and the previous one kept
+	writeKeyPair(t, ca, certPath, keyPath, -time.Hour)
+	require.True(t, p.Changed())
+	require.Error(t, p.Reload())
+	require.False(t, p.Changed())
+	require.Equal(t, first.Leaf.Raw, p.Certificate().Leaf.Raw)
+
+	// as is a key which doesn't match the certificate
+	writeKeyPair(t, ca, certPath, keyPath, 2*time.Hour)
+	keyPEM, err := os.ReadFile(keyPath)
+	require.NoError(t, err)
+	writeKeyPair(t, ca, certPath, filepath.Join(dir, "other.key"), time.Hour)
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+	require.Error(t, p.Reload())
+	require.Equal(t, first.Leaf.Raw, p.Certificate().Leaf.Raw)
+
+	writeKeyPair(t, ca, certPath, keyPath, 2*time.Hour)
+	require.NoError(t, p.Reload())
+	require.False(t, p.Changed())
+	require.NotEqual(t, first.Leaf.Raw, p.Certificate().Leaf.Raw)
+}
@@ -0,0 +1,57 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+type KeyType string
+
+const (
+	// ECDSA keys use the P-256 curve.
+	ECDSA KeyType = "ecdsa"
+	// Ed25519 keys are the most modern, but not supported by most browsers
+	// for TLS yet.
+	Ed25519 KeyType = "ed25519"
+	// RSA keys are 2048 bits, for the oldest clients.
+	RSA KeyType = "rsa"
+)
+
+// KeyTypes lists every supported key type.
+var KeyTypes = []KeyType{ECDSA, Ed25519, RSA}
+
+func ParseKeyType(s string) (KeyType, error) {
+	for _, t := range KeyTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown key type %q (want one of %v)", s, KeyTypes)
+}
+
+// GenerateKey generates a new private key of the given type.
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch t {
+	case ECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case Ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case RSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", t, err)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,127 @@
+// Package clientauth identifies clients by the TLS certificates they
+// present, and lets routes insist on one.
+package clientauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+type Mode string
+
+const (
+	// None ignores client certificates.
+	None Mode = "none"
+	// Optional verifies a certificate if the client presents one.
+	Optional Mode = "optional"
+	// Require refuses clients without a verified certificate.
+	Require Mode = "require"
+)
+
+// Modes lists every supported mode.
+var Modes = []Mode{None, Optional, Require}
+
+func ParseMode(s string) (Mode, error) {
+	for _, m := range Modes {
+		if string(m) == s {
+			return m, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown client auth mode %q (want one of %v)", s, Modes)
+}
+
+// ClientAuthType is the TLS handshake setting which satisfies every given
+// mode, one per group of routes.  Unless all of them require a certificate,
+// it's only verified if given, leaving Enforce to refuse requests to the
+// routes which do.
+func ClientAuthType(modes ...Mode) tls.ClientAuthType {
+	required, requested := true, false
+	for _, m := range modes {
+		required = required && m == Require
+		requested = requested || m != None
+	}
+
+	switch {
+	case required && requested:
+		return tls.RequireAndVerifyClientCert
+	case requested:
+		return tls.VerifyClientCertIfGiven
+	default:
+		return tls.NoClientCert
+	}
+}
+
+type contextKey struct{}
+
+// Identify is middleware storing the identity of the client's verified
+// certificate, if any, for Identity to return.
+func Identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Verified(r) {
+			id := Name(r.TLS.VerifiedChains[0][0])
+			r = r.WithContext(context.WithValue(r.Context(), contextKey{}, id))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Identity returns the identity Identify found, or "" for clients without a
+// verified certificate.  Use Verified to tell whether there is one.
+func Identity(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Verified reports whether the client presented a certificate which was
+// verified.
+func Verified(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// Name is the identity a certificate stands for: its subject's common name,
+// or the whole subject if it has none, or else its first subject alternative
+// name, as certificates with an empty subject must have one, or at worst its
+// serial number.
+func Name(cert *x509.Certificate) string {
+	subject := cert.Subject.String()
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case subject != "":
+		return subject
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.IPAddresses) > 0:
+		return cert.IPAddresses[0].String()
+	default:
+		return "serial " + cert.SerialNumber.String()
+	}
+}
+
+// Enforce returns middleware refusing requests without a verified client
+// certificate if mode is Require, and letting everything through otherwise.
+func Enforce(mode Mode) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if mode != Require {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !Verified(r) {
+				http.Error(w, "a client certificate is required", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package clientauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientAuthType(t *testing.T) {
+	cases := []struct {
+		modes []Mode
+		want  tls.ClientAuthType
+	}{
+		{nil, tls.NoClientCert},
+		{[]Mode{None, None}, tls.NoClientCert},
+		{[]Mode{None, Optional}, tls.VerifyClientCertIfGiven},
+		{[]Mode{None, Require}, tls.VerifyClientCertIfGiven},
+		{[]Mode{Optional, Require}, tls.VerifyClientCertIfGiven},
+		{[]Mode{Require, Require}, tls.RequireAndVerifyClientCert},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.want, ClientAuthType(c.modes...), c.modes)
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	var seen string
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = Identity(r.Context())
+	})
+
+	laptop := &x509.Certificate{Subject: pkix.Name{CommonName: "laptop-42"}}
+	anonymous := &x509.Certificate{Subject: pkix.Name{Organization: []string{"Example"}}}
+	sanOnly := &x509.Certificate{DNSNames: []string{"phone.example.com"}}
+	bare := &x509.Certificate{SerialNumber: big.NewInt(42)}
+
+	cases := []struct {
+		mode   Mode
+		cert   *x509.Certificate
+		status int
+		id     string
+	}{
+		{Optional, nil, http.StatusOK, ""},
+		{Optional, laptop, http.StatusOK, "laptop-42"},
+		{Require, nil, http.StatusForbidden, ""},
+		{Require, laptop, http.StatusOK, "laptop-42"},
+		{Require, anonymous, http.StatusOK, "O=Example"},
+		// an empty subject is verified all the same
+		{Require, sanOnly, http.StatusOK, "phone.example.com"},
+		{Require, bare, http.StatusOK, "serial 42"},
+	}
+
+	for _, c := range cases {
+		seen = ""
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.TLS = &tls.ConnectionState{}
+		if c.cert != nil {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{c.cert}}
+		}
+
+		rec := httptest.NewRecorder()
+		Identify(Enforce(c.mode)(ok)).ServeHTTP(rec, req)
+		require.Equal(t, c.status, rec.Code)
+		require.Equal(t, c.id, seen)
+	}
+}
@@ -0,0 +1,155 @@
+// Package ipfilter admits or refuses requests by the IP address they come
+// from, finding that address behind trusted reverse proxies.
+package ipfilter
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Prefixes are CIDR prefixes.  As a flag, it collects one prefix, or a
+// single address, per use.
+type Prefixes []netip.Prefix
+
+var _ flag.Value = &Prefixes{}
+
+func (p *Prefixes) String() string {
+	return strings.Join(p.Values(), ",")
+}
+
+func (p *Prefixes) Values() []string {
+	values := make([]string, len(*p))
+	for i, prefix := range *p {
+		values[i] = prefix.String()
+	}
+
+	return values
+}
+
+func (p *Prefixes) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return fmt.Errorf("%q is neither a CIDR prefix nor an IP address", value)
+		}
+		*p = append(*p, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		return nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, prefix.Masked())
+
+	return nil
+}
+
+// Contains reports whether addr is in any of the prefixes.
+func (p Prefixes) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter admits requests from Allow, or from anywhere if it's empty, unless
+// they're from Deny.  A nil Filter admits everything.
+type Filter struct {
+	Allow Prefixes
+	Deny  Prefixes
+}
+
+// Allowed reports whether requests from addr are admitted.
+func (f *Filter) Allowed(addr netip.Addr) bool {
+	if f.Deny.Contains(addr) {
+		return false
+	}
+
+	return len(f.Allow) == 0 || f.Allow.Contains(addr)
+}
+
+// Enforce is middleware refusing requests which aren't admitted, or whose
+// address isn't known, e.g. because they came over a unix socket without a
+// trusted proxy saying where from.
+func (f *Filter) Enforce(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := remoteAddr(r)
+		if !ok || !f.Allowed(addr) {
+			http.Error(w, "requests from your address are not allowed here", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TrustProxies returns middleware which, for requests from proxies (or
+// over a unix socket, only reachable by local ones), replaces the request's
+// RemoteAddr with the client's address from X-Forwarded-For, like
+// middleware.RealIP.  Unlike it, the header is read right to left, skipping
+// proxies, so clients can't pass off an address of their choosing.
+func TrustProxies(proxies Prefixes) func(http.Handler) http.Handler {
+	trusted := proxies.Values()
+
+	return func(next http.Handler) http.Handler {
+		if len(proxies) == 0 {
+			return next
+		}
+
+		realIP := middleware.ClientIPFromXFF(trusted...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := middleware.GetClientIPAddr(r.Context()); ip.IsValid() {
+				r.RemoteAddr = ip.String()
+			}
+			next.ServeHTTP(w, r)
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, ok := remoteAddr(r)
+			if ok && !proxies.Contains(addr) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			realIP.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIP returns the IP address a request came from, for logs and per
+// client limits, or its RemoteAddr if that isn't known.
+func ClientIP(r *http.Request) string {
+	if addr, ok := remoteAddr(r); ok {
+		return addr.String()
+	}
+
+	return r.RemoteAddr
+}
+
+// remoteAddr returns the address a request came from, which isn't known
+// for those over unix sockets.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), true
+	}
+	// as set by TrustProxies
+	if addr, err := netip.ParseAddr(r.RemoteAddr); err == nil {
+		return addr.Unmap().WithZone(""), true
+	}
+
+	return netip.Addr{}, false
+}
@@ -0,0 +1,104 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func prefixes(t *testing.T, values ...string) Prefixes {
+	var p Prefixes
+	for _, v := range values {
+		require.NoError(t, p.Set(v))
+	}
+
+	return p
+}
+
+func TestPrefixesFlag(t *testing.T) {
+	p := prefixes(t, "192.168.1.7/24", "10.0.0.1", "fd00::/8")
+	require.Equal(t, "192.168.1.0/24,10.0.0.1/32,fd00::/8", p.String())
+
+	require.True(t, p.Contains(netip.MustParseAddr("192.168.1.200")))
+	require.True(t, p.Contains(netip.MustParseAddr("::ffff:10.0.0.1")))
+	require.False(t, p.Contains(netip.MustParseAddr("10.0.0.2")))
+
+	for _, bad := range []string{"", "192.168.1.0/33", "lan"} {
+		require.Error(t, p.Set(bad), bad)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		allow, deny []string
+		remoteAddr  string
+		status      int
+	}{
+		{nil, nil, "203.0.113.9:1234", http.StatusOK},
+		{[]string{"192.168.1.0/24"}, nil, "192.168.1.20:1234", http.StatusOK},
+		{[]string{"192.168.1.0/24"}, nil, "10.8.0.2:1234", http.StatusForbidden},
+		{[]string{"192.168.1.0/24"}, []string{"192.168.1.66"}, "192.168.1.66:1234", http.StatusForbidden},
+		{nil, []string{"10.8.0.0/16"}, "10.8.0.2:1234", http.StatusForbidden},
+		{nil, []string{"10.8.0.0/16"}, "[::ffff:10.8.0.2]:1234", http.StatusForbidden},
+		{nil, []string{"10.8.0.0/16"}, "[fe80::1%eth0]:1234", http.StatusOK},
+		{nil, []string{"10.8.0.0/16"}, "@", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		f := &Filter{Allow: prefixes(t, c.allow...), Deny: prefixes(t, c.deny...)}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		rec := httptest.NewRecorder()
+		f.Enforce(ok).ServeHTTP(rec, req)
+
+		require.Equal(t, c.status, rec.Code, c)
+	}
+
+	var f *Filter
+	rec := httptest.NewRecorder()
+	f.Enforce(ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestTrustProxies(t *testing.T) {
+	var seen string
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	})
+
+	cases := []struct {
+		proxies    []string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		// without trusted proxies, the header is ignored
+		{nil, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1:1234"},
+		// so it is when it doesn't come from one
+		{[]string{"127.0.0.1"}, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1:1234"},
+		{[]string{"127.0.0.1"}, "127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		// what clients put in front of the proxy's entry doesn't count
+		{[]string{"127.0.0.1"}, "127.0.0.1:1234", "10.0.0.1, 198.51.100.7", "198.51.100.7"},
+		// nor do the proxies in the chain
+		{[]string{"127.0.0.1", "10.0.0.0/8"}, "127.0.0.1:1234", "198.51.100.7, 10.1.2.3", "198.51.100.7"},
+		{[]string{"127.0.0.1"}, "127.0.0.1:1234", "", "127.0.0.1:1234"},
+		{[]string{"127.0.0.1"}, "@", "198.51.100.7", "198.51.100.7"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.xff != "" {
+			req.Header.Set("X-Forwarded-For", c.xff)
+		}
+		seen = ""
+		TrustProxies(prefixes(t, c.proxies...))(record).ServeHTTP(httptest.NewRecorder(), req)
+
+		require.Equal(t, c.want, seen, c)
+	}
+}
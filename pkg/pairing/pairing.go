@@ -0,0 +1,319 @@
+// Package pairing lets browsers in once they've entered a short PIN shown on
+// the server's terminal, handing them a signed session cookie, so ad-hoc
+// sharing needs no passwords.
+package pairing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+)
+
+const (
+	// Path is where the PIN form is posted.
+	Path = "/pair"
+	// PINParam is the query parameter a link may carry the PIN in, e.g.
+	// to bake it into a QR code.
+	PINParam = "pin"
+
+	// CookieName is the session cookie's.
+	CookieName = "fileserver_session"
+	// SessionLifetime is how long a browser stays paired.
+	SessionLifetime = 24 * time.Hour
+
+	// MaxAttempts is how many wrong PINs a client, or an IPv6 /64, may
+	// enter per AttemptWindow.
+	MaxAttempts   = 5
+	AttemptWindow = time.Minute
+	// MaxWrongPINs is how many wrong PINs, from all clients, a PIN
+	// withstands before it's rotated, so it can't be guessed from many
+	// addresses.
+	MaxWrongPINs = 100
+
+	pinDigits = 6
+)
+
+var (
+	ErrWrongPIN        = errors.New("wrong PIN")
+	ErrTooManyAttempts = fmt.Errorf("too many wrong PINs, try again in %s", AttemptWindow)
+)
+
+// Pairing holds the current PIN and the key session cookies are signed
+// with.  A nil Pairing lets everyone in.
+type Pairing struct {
+	// OnRotate, if set, is called with every new PIN but the first, e.g. to
+	// print it.
+	OnRotate func(pin string)
+
+	key []byte
+
+	mu       sync.Mutex
+	pin      string
+	failures map[string]*failures
+	// wrong is how many wrong PINs were entered since pin was set
+	wrong int
+	now   func() time.Time
+}
+
+type failures struct {
+	since time.Time
+	count int
+}
+
+// New returns a Pairing with a random PIN and signing key.  Sessions don't
+// outlive the process.
+func New() (*Pairing, error) {
+	p := &Pairing{
+		key:      make([]byte, sha256.Size),
+		failures: map[string]*failures{},
+		now:      time.Now,
+	}
+	if _, err := rand.Read(p.key); err != nil {
+		return nil, err
+	}
+	if _, err := p.Rotate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// PIN returns the current PIN.
+func (p *Pairing) PIN() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pin
+}
+
+// Rotate replaces the PIN with a new random one, and returns it.  Browsers
+// already paired stay so.
+func (p *Pairing) Rotate() (string, error) {
+	pin, err := newPIN()
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	first := p.pin == ""
+	p.pin = pin
+	p.wrong = 0
+	p.mu.Unlock()
+
+	if !first && p.OnRotate != nil {
+		p.OnRotate(pin)
+	}
+
+	return pin, nil
+}
+
+func newPIN() (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(pinDigits), nil))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", pinDigits, n), nil
+}
+
+// Check reports whether pin is the current one, counting client's wrong
+// guesses towards MaxAttempts, and everyone's towards MaxWrongPINs, upon
+// which the PIN is rotated.
+func (p *Pairing) Check(client, pin string) error {
+	// IPv6 clients tend to have a /64 to pick addresses from
+	if addr, err := netip.ParseAddr(client); err == nil && addr.Is6() && !addr.Is4In6() {
+		client = netip.PrefixFrom(addr, 64).Masked().String()
+	}
+
+	rotate, err := p.check(client, pin)
+	if rotate {
+		// rather than lock everyone out, have the guessers start over
+		log.Printf("pairing: %d wrong PINs entered, replacing the PIN", MaxWrongPINs)
+		if _, err := p.Rotate(); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return err
+}
+
+// check is Check, also reporting whether the PIN must be rotated.
+func (p *Pairing) check(client, pin string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	for c, f := range p.failures {
+		if now.Sub(f.since) >= AttemptWindow {
+			delete(p.failures, c)
+		}
+	}
+	f := p.failures[client]
+	if f != nil && f.count >= MaxAttempts {
+		return false, ErrTooManyAttempts
+	}
+
+	if hmac.Equal([]byte(strings.TrimSpace(pin)), []byte(p.pin)) {
+		return false, nil
+	}
+
+	if f == nil {
+		f = &failures{since: now}
+		p.failures[client] = f
+	}
+	f.count++
+	p.wrong++
+
+	return p.wrong >= MaxWrongPINs, ErrWrongPIN
+}
+
+// Require is middleware letting paired browsers through.  Others are
+// paired if the URL carries the right PIN, or else shown the PIN form.
+func (p *Pairing) Require(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.paired(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		pin := query.Get(PINParam)
+		if pin == "" {
+			p.form(w, r.URL.RequestURI(), "", http.StatusForbidden)
+			return
+		}
+
+		query.Del(PINParam)
+		target := *r.URL
+		target.RawQuery = query.Encode()
+		p.pair(w, r, pin, target.RequestURI())
+	})
+}
+
+// ServeHTTP handles the PIN form being posted to Path.
+func (p *Pairing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	next := r.PostFormValue("next")
+	// only ever send the browser back to this server
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	p.pair(w, r, r.PostFormValue(PINParam), next)
+}
+
+// pair checks pin, and on success gives the browser a session and sends it
+// on to next.
+func (p *Pairing) pair(w http.ResponseWriter, r *http.Request, pin, next string) {
+	client := ipfilter.ClientIP(r)
+	switch err := p.Check(client, pin); {
+	case errors.Is(err, ErrTooManyAttempts):
+		log.Printf("pairing refused for %s: %v", client, err)
+		w.Header().Set("Retry-After", fmt.Sprint(int(AttemptWindow.Seconds())))
+		p.form(w, next, err.Error(), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		log.Printf("pairing failed for %s: %v", client, err)
+		p.form(w, next, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	log.Printf("paired %s", client)
+	http.SetCookie(w, p.cookie(r))
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// cookie returns a new session cookie, valid for SessionLifetime.
+func (p *Pairing) cookie(r *http.Request) *http.Cookie {
+	expires := p.now().Add(SessionLifetime)
+
+	return &http.Cookie{
+		Name:     CookieName,
+		Value:    p.sign(expires),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sign returns a session value holding its expiry, authenticated with key.
+func (p *Pairing) sign(expires time.Time) string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(b)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b))
+}
+
+// paired reports whether the request carries a valid, unexpired session.
+func (p *Pairing) paired(r *http.Request) bool {
+	c, err := r.Cookie(CookieName)
+	if err != nil {
+		return false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil), b[8:]) {
+		return false
+	}
+
+	return p.now().Unix() < int64(binary.BigEndian.Uint64(b[:8]))
+}
+
+var formTemplate = template.Must(template.New("pair").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>FileServer</title>
+</head>
+<body>
+<h1>FileServer</h1>
+<form method="post" action="{{.Path}}">
+<p>Enter the PIN shown where the server runs.</p>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<input type="hidden" name="next" value="{{.Next}}">
+<input name="{{.Param}}" inputmode="numeric" autocomplete="one-time-code" autofocus required>
+<button type="submit">Pair</button>
+</form>
+</body>
+</html>
+`))
+
+func (p *Pairing) form(w http.ResponseWriter, next, errMsg string, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := formTemplate.Execute(w, struct{ Path, Param, Next, Error string }{Path, PINParam, next, errMsg})
+	if err != nil {
+		log.Println(err)
+	}
+}
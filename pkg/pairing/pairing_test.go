@@ -0,0 +1,156 @@
+package pairing
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+	require.Len(t, p.PIN(), pinDigits)
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	for range MaxAttempts {
+		require.ErrorIs(t, p.Check("192.0.2.1", "wrong"), ErrWrongPIN)
+	}
+	// even the right PIN is refused once a client has guessed too often...
+	require.ErrorIs(t, p.Check("192.0.2.1", p.PIN()), ErrTooManyAttempts)
+	// ...but not for other clients
+	require.NoError(t, p.Check("192.0.2.2", p.PIN()))
+
+	now = now.Add(AttemptWindow)
+	require.NoError(t, p.Check("192.0.2.1", p.PIN()))
+
+	// addresses in one IPv6 /64 count as one client
+	for i := range MaxAttempts {
+		require.ErrorIs(t, p.Check(fmt.Sprintf("2001:db8::%d", i+1), "wrong"), ErrWrongPIN)
+	}
+	require.ErrorIs(t, p.Check("2001:db8::ffff", p.PIN()), ErrTooManyAttempts)
+	require.NoError(t, p.Check("2001:db8:0:1::1", p.PIN()))
+
+	old := p.PIN()
+	pin, err := p.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, pin, p.PIN())
+	if pin != old {
+		require.ErrorIs(t, p.Check("192.0.2.3", old), ErrWrongPIN)
+	}
+}
+
+func TestMaxWrongPINs(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+	var rotated []string
+	p.OnRotate = func(pin string) { rotated = append(rotated, pin) }
+
+	// a PIN guessed at from many addresses is replaced...
+	old := p.PIN()
+	for i := range MaxWrongPINs {
+		require.ErrorIs(t, p.Check(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "wrong"), ErrWrongPIN)
+	}
+	require.Equal(t, []string{p.PIN()}, rotated)
+	if p.PIN() != old {
+		require.ErrorIs(t, p.Check("192.0.2.1", old), ErrWrongPIN)
+	}
+
+	// ...with one which works as usual
+	require.NoError(t, p.Check("192.0.2.1", p.PIN()))
+}
+
+func TestRequire(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := p.Require(ok)
+	get := func(target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// unpaired browsers get the form
+	rec := get("/data/", nil)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), `action="/pair"`)
+
+	rec = get("/data/?pin=wrong", nil)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), ErrWrongPIN.Error())
+
+	// the PIN in a link pairs, and is dropped from the URL
+	rec = get("/data/?sort=name&pin="+p.PIN(), nil)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "/data/?sort=name", rec.Header().Get("Location"))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	session := cookies[0]
+	require.True(t, session.HttpOnly)
+
+	require.Equal(t, http.StatusOK, get("/data/", session).Code)
+
+	forged := *session
+	forged.Value = strings.ToUpper(forged.Value)
+	require.Equal(t, http.StatusForbidden, get("/data/", &forged).Code)
+
+	// rotating the PIN keeps sessions, which expire in their own time
+	_, err = p.Rotate()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, get("/data/", session).Code)
+	now = now.Add(SessionLifetime)
+	require.Equal(t, http.StatusForbidden, get("/data/", session).Code)
+
+	// without a Pairing, everyone is let in
+	var none *Pairing
+	rec = httptest.NewRecorder()
+	none.Require(ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestServeHTTP(t *testing.T) {
+	p, err := New()
+	require.NoError(t, err)
+
+	cases := []struct {
+		pin, next string
+		status    int
+		location  string
+	}{
+		{p.PIN(), "/uploader/", http.StatusSeeOther, "/uploader/"},
+		{p.PIN(), "//elsewhere.example/", http.StatusSeeOther, "/"},
+		{p.PIN(), "https://elsewhere.example/", http.StatusSeeOther, "/"},
+		{"wrong", "/uploader/", http.StatusForbidden, ""},
+	}
+
+	for _, c := range cases {
+		form := url.Values{PINParam: {c.pin}, "next": {c.next}}
+		req := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+
+		require.Equal(t, c.status, rec.Code, c)
+		require.Equal(t, c.location, rec.Header().Get("Location"), c)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path, nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -3,9 +3,10 @@ package safepath
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 )
 
-type TooManyConsecutiveDotsErr struct {}
+type TooManyConsecutiveDotsErr struct{}
 
 var _ error = &TooManyConsecutiveDotsErr{}
 
@@ -74,3 +75,51 @@ func Clean(input string) (string, error) {
 	// got here, so the input matched without error
 	return input, nil
 }
+
+type TooDeepErr struct {
+	depth uint
+	max   uint
+}
+
+var _ error = &TooDeepErr{}
+
+func (m TooDeepErr) Error() string {
+	return fmt.Sprintf("too many path segments (%v, at most %v allowed)", m.depth, m.max)
+}
+
+type EmptySegmentErr struct{}
+
+var _ error = &EmptySegmentErr{}
+
+func (m EmptySegmentErr) Error() string {
+	return "empty path segment"
+}
+
+// CleanRelative validates a relative path of at most maxDepth segments, as
+// sent by a browser uploading a folder (e.g. webkitRelativePath).  Segments
+// are separated by "/" whatever the platform, and each one must pass Clean.
+// The result uses the platform's file separator.
+func CleanRelative(input string, maxDepth uint) (string, error) {
+	segments := strings.Split(input, "/")
+
+	depth := uint(len(segments))
+	if depth > maxDepth {
+		return "", TooDeepErr{depth, maxDepth}
+	}
+
+	for i, segment := range segments {
+		// an empty segment is a leading "/" (an absolute path), a trailing
+		// "/" or "//"; "." has no place in a path we did not build
+		if segment == "" || segment == "." {
+			return "", EmptySegmentErr{}
+		}
+
+		cleaned, err := Clean(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = cleaned
+	}
+
+	return filepath.Join(segments...), nil
+}
@@ -51,3 +51,51 @@ func TestSafePath(t *testing.T) {
 		require.Equal(t, tc.output, output)
 	}
 }
+
+func TestSafeRelativePath(t *testing.T) {
+	cases := map[string]struct {
+		output        string
+		expectedError error
+	}{
+		"good": {
+			output:        "good",
+			expectedError: nil,
+		},
+		"project/src/main.go": {
+			output:        filepath.Join("project", "src", "main.go"),
+			expectedError: nil,
+		},
+		"project/../../escape": {
+			output:        "",
+			expectedError: &TooManyConsecutiveDotsErr{},
+		},
+		"/etc/passwd": {
+			output:        "",
+			expectedError: &EmptySegmentErr{},
+		},
+		"project//main.go": {
+			output:        "",
+			expectedError: &EmptySegmentErr{},
+		},
+		"project/./main.go": {
+			output:        "",
+			expectedError: &EmptySegmentErr{},
+		},
+		"a/b/c/d/e": {
+			output:        "",
+			expectedError: &TooDeepErr{},
+		},
+	}
+
+	for input, tc := range cases {
+		output, err := CleanRelative(input, 4)
+
+		if tc.expectedError != nil {
+			require.ErrorAs(t, err, tc.expectedError)
+		} else {
+			require.NoError(t, err)
+		}
+
+		require.Equal(t, tc.output, output)
+	}
+}
@@ -0,0 +1,64 @@
+// Package sandbox restricts what the process can do once it has set itself
+// up.  A Policy describes what is needed and each platform enforces as much
+// of it as it can: unveil(2) and pledge(2) on OpenBSD, Landlock on Linux,
+// nothing elsewhere.
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"slices"
+)
+
+// ErrUnsupported is returned when the platform or kernel offers no way to
+// restrict filesystem access.  Callers may choose to carry on unrestricted.
+var ErrUnsupported = errors.New("filesystem sandboxing is not supported on this system")
+
+// Capability is something beyond filesystem access the process still needs
+// once locked down.
+type Capability string
+
+const (
+	// Inet allows serving (and opening) network connections.
+	Inet Capability = "inet"
+	// DNS allows resolving host names.
+	DNS Capability = "dns"
+	// Unix allows serving connections on unix sockets.
+	Unix Capability = "unix"
+)
+
+// Policy describes everything the process needs after start up.
+type Policy struct {
+	// ReadOnly paths (files or directories) may be read.
+	ReadOnly []string
+	// ReadWrite directories may be read, written and created in.
+	ReadWrite []string
+	// Capabilities are needed besides filesystem access.
+	Capabilities []Capability
+}
+
+// resolverFiles are read when resolving host names, so they're readable
+// whenever the DNS capability is needed.
+var resolverFiles = []string{"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf"}
+
+// Unveil limits filesystem access to the policy's paths.  It returns
+// ErrUnsupported where that isn't possible.
+func (p Policy) Unveil() error {
+	if slices.Contains(p.Capabilities, DNS) {
+		p.ReadOnly = slices.Clip(p.ReadOnly)
+		for _, f := range resolverFiles {
+			if _, err := os.Stat(f); err == nil {
+				p.ReadOnly = append(p.ReadOnly, f)
+			}
+		}
+	}
+
+	return unveil(p)
+}
+
+// Pledge drops every capability the policy doesn't list.  It is meant to be
+// called last, once listeners are open and certificates loaded, and is a
+// no-op where the platform has no equivalent.
+func (p Policy) Pledge() error {
+	return pledge(p)
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// rights which may be granted on a regular file, as opposed to a
+	// directory
+	fileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+		unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+	readAccess = unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+	readWriteAccess = readAccess |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_REFER |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// errCgo is returned when the binary was built with cgo, which keeps
+// Landlock from reaching every thread.
+var errCgo = fmt.Errorf("%w: Landlock needs a binary built with CGO_ENABLED=0", ErrUnsupported)
+
+// unveil uses Landlock to limit the process to reading p.ReadOnly and
+// reading, writing and creating below p.ReadWrite.  It returns ErrUnsupported
+// when the kernel lacks Landlock (or it is disabled), or errCgo, wrapping it,
+// when the binary was built with cgo.
+func unveil(p Policy) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		if errno == unix.ENOSYS || errno == unix.EOPNOTSUPP {
+			return ErrUnsupported
+		}
+		return fmt.Errorf("landlock: querying ABI version: %w", errno)
+	}
+	if abi < 2 {
+		// ABI 1 always denies renaming and linking across directories,
+		// which uploads rely on to be moved into place
+		return fmt.Errorf("%w: Landlock ABI %d can't allow renaming across directories", ErrUnsupported, abi)
+	}
+
+	handled := handledAccess(int(abi))
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: creating ruleset: %w", errno)
+	}
+	defer func() { _ = unix.Close(int(fd)) }()
+
+	for _, path := range p.ReadOnly {
+		if err := addRule(int(fd), path, readAccess&handled); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.ReadWrite {
+		if err := addRule(int(fd), path, readWriteAccess&handled); err != nil {
+			return err
+		}
+	}
+
+	// landlock_restrict_self only affects the calling thread, so it (and the
+	// no_new_privs it requires) has to be applied to every thread the
+	// runtime has started
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errCgo
+		}
+		return fmt.Errorf("landlock: setting no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: restricting self: %w", errno)
+	}
+
+	return nil
+}
+
+// pledge is a no-op: Landlock only covers the filesystem, which unveil has
+// already restricted.
+func pledge(Policy) error { return nil }
+
+// handledAccess returns every filesystem right the given Landlock ABI
+// version (2 or later) knows about; anything it handles is denied unless a
+// rule grants it.
+func handledAccess(abi int) uint64 {
+	// ABI 1 and 2
+	access := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+		unix.LANDLOCK_ACCESS_FS_REFER)
+
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+
+	return access
+}
+
+func addRule(rulesetFd int, path string, access uint64) error {
+	f, err := os.OpenFile(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("landlock: %w", err)
+	}
+	if !fi.IsDir() {
+		access &= fileAccess
+	}
+
+	attr := unix.LandlockPathBeneathAttr{
+		Allowed_access: access,
+		Parent_fd:      int32(f.Fd()),
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: adding rule for %s: %w", path, errno)
+	}
+
+	return nil
+}
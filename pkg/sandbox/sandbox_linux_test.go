@@ -0,0 +1,77 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Landlock can't be lifted once applied, so the test re-runs itself in a
+// child process which does the unveiling.  testify is left out on purpose:
+// it pulls in cgo, which stops unveil from reaching every thread.
+const childEnv = "SANDBOX_TEST_CHILD"
+
+func TestUnveil(t *testing.T) {
+	if os.Getenv(childEnv) != "" {
+		unveiledChild(t)
+		return
+	}
+
+	base := t.TempDir()
+	for _, d := range []string{"ro", "rw", filepath.Join("rw", "sub"), "hidden"} {
+		if err := os.Mkdir(filepath.Join(base, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(base, d, "file"), []byte(d), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUnveil$", "-test.v")
+	cmd.Env = append(os.Environ(), childEnv+"="+base)
+	out, err := cmd.CombinedOutput()
+	t.Logf("%s", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func unveiledChild(t *testing.T) {
+	base := os.Getenv(childEnv)
+	ro := filepath.Join(base, "ro")
+	rw := filepath.Join(base, "rw")
+
+	err := Policy{ReadOnly: []string{ro}, ReadWrite: []string{rw}}.Unveil()
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.ReadFile(filepath.Join(ro, "file")); err != nil {
+		t.Errorf("reading read-only dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ro, "new"), nil, 0600); err == nil {
+		t.Error("created a file in read-only dir")
+	}
+	if err := os.WriteFile(filepath.Join(rw, "new"), nil, 0600); err != nil {
+		t.Errorf("creating a file in read-write dir: %v", err)
+	}
+	if err := os.Rename(filepath.Join(rw, "new"), filepath.Join(rw, "renamed")); err != nil {
+		t.Errorf("renaming within read-write dir: %v", err)
+	}
+	if err := os.Rename(filepath.Join(rw, "renamed"), filepath.Join(rw, "sub", "moved")); err != nil {
+		t.Errorf("renaming across read-write dirs: %v", err)
+	}
+	if err := os.Rename(filepath.Join(rw, "sub", "file"), filepath.Join(ro, "moved")); err == nil {
+		t.Error("renamed a file into read-only dir")
+	}
+	if _, err := os.ReadFile(filepath.Join(base, "hidden", "file")); err == nil {
+		t.Error("read a file outside the unveiled paths")
+	}
+}
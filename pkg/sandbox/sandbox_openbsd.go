@@ -0,0 +1,40 @@
+//go:build openbsd
+
+package sandbox
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func unveil(p Policy) error {
+	for _, d := range p.ReadOnly {
+		if err := unix.Unveil(d, "r"); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range p.ReadWrite {
+		if err := unix.Unveil(d, "rwc"); err != nil {
+			return err
+		}
+	}
+
+	return unix.UnveilBlock()
+}
+
+func pledge(p Policy) error {
+	promises := []string{"stdio"}
+	if len(p.ReadOnly) > 0 || len(p.ReadWrite) > 0 {
+		promises = append(promises, "rpath")
+	}
+	if len(p.ReadWrite) > 0 {
+		promises = append(promises, "wpath", "cpath")
+	}
+	for _, c := range p.Capabilities {
+		promises = append(promises, string(c))
+	}
+
+	return unix.PledgePromises(strings.Join(promises, " "))
+}
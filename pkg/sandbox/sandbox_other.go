@@ -0,0 +1,7 @@
+//go:build !openbsd && !linux
+
+package sandbox
+
+func unveil(Policy) error { return ErrUnsupported }
+
+func pledge(Policy) error { return nil }
@@ -0,0 +1,385 @@
+// Package share mints and checks links to single files, and upload requests
+// letting outsiders upload into a folder.  A token names the file or folder,
+// when it expires and optionally how much it may be used, signed with a key
+// persisted on local disk so tokens outlive restarts.  So does their usage.
+package share
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	keyFile   = "share.key"
+	usageFile = "usage.json"
+)
+
+var (
+	ErrInvalid   = errors.New("invalid link")
+	ErrExpired   = errors.New("link expired")
+	ErrExhausted = errors.New("link used up")
+)
+
+// Link is what a token grants.
+type Link struct {
+	// Path is the file's, slash separated and relative to the shared
+	// directory.
+	Path    string
+	Expires time.Time
+	// MaxDownloads is how many times the link may be used, 0 for no limit.
+	MaxDownloads int
+}
+
+// Request is what an upload request token grants.
+type Request struct {
+	// Folder is where uploads go, slash separated and relative to the
+	// upload directory.
+	Folder  string
+	Expires time.Time
+	// MaxBytes and MaxFiles cap how much may be uploaded in all, 0 for no
+	// limit.
+	MaxBytes int64
+	MaxFiles int
+}
+
+// claims is a Link or a Request as encoded in a token.  The nonce tells
+// apart the usage of tokens minted for the same thing at the same time.
+type claims struct {
+	Path         string `json:"p,omitempty"`
+	Folder       string `json:"u,omitempty"`
+	Expires      int64  `json:"e"`
+	MaxDownloads int    `json:"n,omitempty"`
+	MaxBytes     int64  `json:"b,omitempty"`
+	MaxFiles     int    `json:"f,omitempty"`
+	Nonce        []byte `json:"r"`
+}
+
+// Shares mints and checks tokens with the key persisted in a directory.
+type Shares struct {
+	dir string
+	key []byte
+
+	mu sync.Mutex
+	// used is how much limited tokens were used, by signature, until they
+	// expire
+	used map[string]*usage
+	now  func() time.Time
+}
+
+// usage is how many times a link was downloaded, or how many files and
+// bytes were uploaded with a request.
+type usage struct {
+	Expires int64 `json:"expires"`
+	Count   int   `json:"count"`
+	Bytes   int64 `json:"bytes,omitempty"`
+}
+
+// Open loads the key and usage persisted in dir, generating (and persisting)
+// a new key if there is none yet.
+func Open(dir string) (*Shares, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Shares{dir: dir, used: map[string]*usage{}, now: time.Now}
+
+	key, err := os.ReadFile(filepath.Join(dir, keyFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, keyFile), key, 0600); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case len(key) < sha256.Size:
+		return nil, errors.New(filepath.Join(dir, keyFile) + " is too short")
+	}
+	s.key = key
+
+	b, err := os.ReadFile(filepath.Join(dir, usageFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &s.used); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Mint returns a token granting link.
+func (s *Shares) Mint(link Link) (string, error) {
+	return s.mint(claims{Path: link.Path, Expires: link.Expires.Unix(), MaxDownloads: link.MaxDownloads})
+}
+
+// MintRequest returns a token granting req.
+func (s *Shares) MintRequest(req Request) (string, error) {
+	return s.mint(claims{Folder: req.Folder, Expires: req.Expires.Unix(), MaxBytes: req.MaxBytes, MaxFiles: req.MaxFiles})
+}
+
+func (s *Shares) mint(c claims) (string, error) {
+	c.Nonce = make([]byte, 8)
+	if _, err := rand.Read(c.Nonce); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload)), nil
+}
+
+// Check returns what token grants, if it's genuine, unexpired and not used
+// up, without using it.
+func (s *Shares) Check(token string) (Link, error) {
+	link, _, err := s.check(token)
+
+	return link, err
+}
+
+// Use is Check, counting a download.
+func (s *Shares) Use(token string) (Link, error) {
+	link, id, err := s.check(token)
+	if err != nil || link.MaxDownloads == 0 {
+		return link, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.usage(id, link.Expires)
+	if u.Count >= link.MaxDownloads {
+		return Link{}, ErrExhausted
+	}
+	u.Count++
+
+	// a download which couldn't be counted mustn't happen
+	if err := s.save(); err != nil {
+		u.Count--
+		return Link{}, err
+	}
+
+	return link, nil
+}
+
+func (s *Shares) check(token string) (Link, string, error) {
+	c, id, err := s.decode(token)
+	if err != nil {
+		return Link{}, "", err
+	}
+	if c.Path == "" || c.Folder != "" || c.MaxDownloads < 0 {
+		return Link{}, "", ErrInvalid
+	}
+	link := Link{Path: c.Path, Expires: time.Unix(c.Expires, 0).UTC(), MaxDownloads: c.MaxDownloads}
+
+	if link.MaxDownloads > 0 {
+		s.mu.Lock()
+		u := s.used[id]
+		exhausted := u != nil && u.Count >= link.MaxDownloads
+		s.mu.Unlock()
+		if exhausted {
+			return Link{}, "", ErrExhausted
+		}
+	}
+
+	return link, id, nil
+}
+
+// CheckRequest returns what token grants, if it's a genuine upload request,
+// unexpired and not used up.
+func (s *Shares) CheckRequest(token string) (Request, error) {
+	req, _, err := s.checkRequest(token)
+
+	return req, err
+}
+
+func (s *Shares) checkRequest(token string) (Request, string, error) {
+	c, id, err := s.decode(token)
+	if err != nil {
+		return Request{}, "", err
+	}
+	if c.Folder == "" || c.Path != "" || c.MaxBytes < 0 || c.MaxFiles < 0 {
+		return Request{}, "", ErrInvalid
+	}
+	req := Request{Folder: c.Folder, Expires: time.Unix(c.Expires, 0).UTC(), MaxBytes: c.MaxBytes, MaxFiles: c.MaxFiles}
+
+	s.mu.Lock()
+	u := s.used[id]
+	exhausted := u != nil && req.exhausted(u)
+	s.mu.Unlock()
+	if exhausted {
+		return Request{}, "", ErrExhausted
+	}
+
+	return req, id, nil
+}
+
+// exhausted reports whether u leaves nothing of the request to use.
+func (req Request) exhausted(u *usage) bool {
+	return (req.MaxFiles > 0 && u.Count >= req.MaxFiles) || (req.MaxBytes > 0 && u.Bytes >= req.MaxBytes)
+}
+
+// Receive starts receiving a file uploaded with the upload request token,
+// read from r.  The file counts against the request's MaxFiles, and what's
+// read against its MaxBytes; reading fails with ErrExhausted once that's
+// exceeded.  Done must be called once the file is stored, or given up on.
+func (s *Shares) Receive(token string, r io.Reader) (*Incoming, error) {
+	req, id, err := s.checkRequest(token)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.usage(id, req.Expires)
+	if req.MaxFiles > 0 && u.Count >= req.MaxFiles {
+		return nil, ErrExhausted
+	}
+	u.Count++
+
+	return &Incoming{Request: req, s: s, u: u, r: r}, nil
+}
+
+// Incoming is a file being uploaded with an upload request.
+type Incoming struct {
+	Request
+
+	s    *Shares
+	u    *usage
+	r    io.Reader
+	read int64
+}
+
+func (in *Incoming) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+
+	in.s.mu.Lock()
+	in.read += int64(n)
+	in.u.Bytes += int64(n)
+	exceeded := in.MaxBytes > 0 && in.u.Bytes > in.MaxBytes
+	in.s.mu.Unlock()
+
+	if exceeded {
+		return n, fmt.Errorf("%w: the upload request allows %d bytes in all", ErrExhausted, in.MaxBytes)
+	}
+
+	return n, err
+}
+
+// Done persists the request's usage, no longer counting the file against it
+// unless it was stored.
+func (in *Incoming) Done(stored bool) error {
+	in.s.mu.Lock()
+	defer in.s.mu.Unlock()
+
+	if !stored {
+		in.u.Count--
+		in.u.Bytes -= in.read
+	}
+
+	return in.s.save()
+}
+
+// decode returns the claims of a genuine, unexpired token, and the ID its
+// usage is kept under.
+func (s *Shares) decode(token string) (claims, string, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims{}, "", ErrInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return claims{}, "", ErrInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return claims{}, "", ErrInvalid
+	}
+
+	var c claims
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return claims{}, "", ErrInvalid
+	}
+	if !s.now().Before(time.Unix(c.Expires, 0)) {
+		return claims{}, "", ErrExpired
+	}
+
+	return c, hex.EncodeToString(sig), nil
+}
+
+// usage returns the usage of the token with id, which expires at expires.
+// s.mu must be held.
+func (s *Shares) usage(id string, expires time.Time) *usage {
+	u := s.used[id]
+	if u == nil {
+		u = &usage{Expires: expires.Unix()}
+		s.used[id] = u
+	}
+
+	return u
+}
+
+func (s *Shares) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+// save persists the usage, forgetting that of expired tokens.  s.mu must be
+// held.
+func (s *Shares) save() error {
+	now := s.now().Unix()
+	for id, u := range s.used {
+		if u.Expires <= now {
+			delete(s.used, id)
+		}
+	}
+
+	b, err := json.Marshal(s.used)
+	if err != nil {
+		return err
+	}
+
+	// replace the file in one go, so a crash can't leave half of it
+	f, err := os.CreateTemp(s.dir, "."+usageFile+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.dir, usageFile))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+
+	return err
+}
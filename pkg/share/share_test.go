@@ -0,0 +1,156 @@
+package share
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMintAndUse(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	unlimited, err := s.Mint(Link{Path: "docs/a.pdf", Expires: now.Add(time.Hour)})
+	require.NoError(t, err)
+	limited, err := s.Mint(Link{Path: "docs/a.pdf", Expires: now.Add(time.Hour), MaxDownloads: 2})
+	require.NoError(t, err)
+
+	link, err := s.Check(limited)
+	require.NoError(t, err)
+	require.Equal(t, Link{Path: "docs/a.pdf", Expires: now.Add(time.Hour), MaxDownloads: 2}, link)
+
+	for range 3 {
+		_, err = s.Use(unlimited)
+		require.NoError(t, err)
+	}
+
+	for range 2 {
+		_, err = s.Use(limited)
+		require.NoError(t, err)
+	}
+	_, err = s.Use(limited)
+	require.ErrorIs(t, err, ErrExhausted)
+	_, err = s.Check(limited)
+	require.ErrorIs(t, err, ErrExhausted)
+
+	// the key and counts survive reopening
+	s, err = Open(dir)
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+	_, err = s.Check(unlimited)
+	require.NoError(t, err)
+	_, err = s.Use(limited)
+	require.ErrorIs(t, err, ErrExhausted)
+
+	now = now.Add(time.Hour)
+	_, err = s.Use(unlimited)
+	require.ErrorIs(t, err, ErrExpired)
+}
+
+func TestInvalidTokens(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	token, err := s.Mint(Link{Path: "a.txt", Expires: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	payload, sig, _ := strings.Cut(token, ".")
+
+	other, err := Open(t.TempDir())
+	require.NoError(t, err)
+	forged, err := other.Mint(Link{Path: "secret.txt", Expires: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+
+	for _, token := range []string{
+		"",
+		payload,
+		payload + ".",
+		payload + "." + sig[1:],
+		forgedPayload + "." + sig,
+		forged,
+		"%%%." + sig,
+	} {
+		_, err := s.Check(token)
+		require.ErrorIs(t, err, ErrInvalid, token)
+	}
+}
+
+func TestOpenRejectsShortKey(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, keyFile), []byte("short"), 0600))
+
+	_, err := Open(dir)
+	require.Error(t, err)
+}
+
+func TestUploadRequests(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	token, err := s.MintRequest(Request{Folder: "from/alice", Expires: now.Add(time.Hour), MaxBytes: 10, MaxFiles: 2})
+	require.NoError(t, err)
+
+	// tokens of one kind aren't valid as the other
+	_, err = s.Check(token)
+	require.ErrorIs(t, err, ErrInvalid)
+	link, err := s.Mint(Link{Path: "a.txt", Expires: now.Add(time.Hour)})
+	require.NoError(t, err)
+	_, err = s.CheckRequest(link)
+	require.ErrorIs(t, err, ErrInvalid)
+
+	req, err := s.CheckRequest(token)
+	require.NoError(t, err)
+	require.Equal(t, "from/alice", req.Folder)
+
+	// a file which wasn't stored doesn't count
+	in, err := s.Receive(token, strings.NewReader("0123456789abc"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(in)
+	require.ErrorIs(t, err, ErrExhausted)
+	require.NoError(t, in.Done(false))
+
+	for _, content := range []string{"0123", "456"} {
+		in, err := s.Receive(token, strings.NewReader(content))
+		require.NoError(t, err)
+		_, err = io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Done(true))
+	}
+
+	// no files are left, which survives reopening
+	s, err = Open(dir)
+	require.NoError(t, err)
+	s.now = func() time.Time { return now }
+	_, err = s.Receive(token, strings.NewReader("x"))
+	require.ErrorIs(t, err, ErrExhausted)
+	_, err = s.CheckRequest(token)
+	require.ErrorIs(t, err, ErrExhausted)
+
+	// bytes run out too
+	token, err = s.MintRequest(Request{Folder: "bob", Expires: now.Add(time.Hour), MaxBytes: 4})
+	require.NoError(t, err)
+	in, err = s.Receive(token, strings.NewReader("0123"))
+	require.NoError(t, err)
+	_, err = io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Done(true))
+	_, err = s.CheckRequest(token)
+	require.ErrorIs(t, err, ErrExhausted)
+
+	now = now.Add(time.Hour)
+	_, err = s.CheckRequest(token)
+	require.ErrorIs(t, err, ErrExpired)
+}
@@ -0,0 +1,536 @@
+// Package tus implements the core of the tus 1.0 resumable upload protocol
+// (https://tus.io/protocols/resumable-upload) with the creation and
+// termination extensions.  Partial uploads are kept on disk so they survive
+// a server restart.
+package tus
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+)
+
+const (
+	Version    = "1.0.0"
+	Extensions = "creation,termination"
+
+	offsetContentType = "application/offset+octet-stream"
+	infoSuffix        = ".info"
+	dataSuffix        = ".bin"
+)
+
+// Info describes an upload, as persisted next to its data.
+type Info struct {
+	ID       string            `json:"id"`
+	Size     int64             `json:"size"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Client is the address the upload was created from.
+	Client string `json:"client,omitempty"`
+
+	// Offset is the number of bytes received so far.  It is derived from
+	// the size of the data file rather than stored.
+	Offset int64 `json:"-"`
+}
+
+// CompleteFunc is called once every byte of an upload has arrived.  name is
+// the file holding the upload's data, relative to the Handler's Root; the
+// callback is expected to move it to its final destination.  The upload's
+// bookkeeping is removed afterwards.
+type CompleteFunc func(info Info, name string) error
+
+// Handler serves the tus protocol for uploads stored in Root.
+type Handler struct {
+	// BasePath is the URL path the handler is mounted on, used to build
+	// the Location of newly created uploads.
+	BasePath string
+	// Root holds partial uploads; every file is reached through it.
+	Root *os.Root
+	// MaxSize, if positive, is the largest upload that will be accepted.
+	MaxSize int64
+	// OnCreate, if set, may veto a new upload before anything is stored.
+	OnCreate func(r *http.Request, info Info) error
+	// OnComplete finalizes uploads.
+	OnComplete CompleteFunc
+	// OnDiscard, if set, is told of uploads removed without completing:
+	// terminated, swept or failing to complete.
+	OnDiscard func(info Info)
+	// ErrorStatus, if set, maps an error returned by OnCreate or OnComplete
+	// to the HTTP status reported to the client.  Uploads failing to
+	// complete with a 4xx status are discarded, as retrying them cannot
+	// succeed.
+	ErrorStatus func(error) int
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+// uploadLock serializes requests against a single upload, and counts those
+// holding or waiting for it.
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// New returns a Handler storing partial uploads in root.
+func New(basePath string, root *os.Root, onComplete CompleteFunc) *Handler {
+	return &Handler{
+		BasePath:   strings.TrimSuffix(basePath, "/") + "/",
+		Root:       root,
+		OnComplete: onComplete,
+		locks:      map[string]*uploadLock{},
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	w.Header().Set("Tus-Resumable", Version)
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", Version)
+		w.Header().Set("Tus-Extension", Extensions)
+		if h.MaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != Version {
+		w.Header().Set("Tus-Version", Version)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(h.BasePath, "/")), "/")
+
+	switch {
+	case method == http.MethodPost && id == "":
+		h.create(w, r)
+	case method == http.MethodHead && id != "":
+		h.head(w, id)
+	case method == http.MethodPatch && id != "":
+		h.patch(w, r, id)
+	case method == http.MethodDelete && id != "":
+		h.terminate(w, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) create(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if h.MaxSize > 0 && size > h.MaxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := ParseMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	info := Info{ID: id, Size: size, Metadata: metadata, Client: ipfilter.ClientIP(r)}
+	if h.OnCreate != nil {
+		if err := h.OnCreate(r, info); err != nil {
+			log.Println(err)
+			w.WriteHeader(h.errorStatus(err))
+			return
+		}
+	}
+
+	if err := h.writeInfo(info); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the data file becomes the stored upload, so give it the mode os.Create
+	// would
+	f, err := h.Root.OpenFile(dataName(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = f.Close()
+
+	w.Header().Set("Location", h.BasePath+id)
+
+	// an empty upload is complete as soon as it exists
+	if size == 0 {
+		if err := h.complete(info); err != nil {
+			h.completeFailed(w, info, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *Handler) head(w http.ResponseWriter, id string) {
+	unlock := h.lock(id)
+	defer unlock()
+
+	info, err := h.readInfo(id)
+	if err != nil {
+		writeInfoError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Size, 10))
+	if len(info.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", FormatMetadata(info.Metadata))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != offsetContentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	unlock := h.lock(id)
+	defer unlock()
+
+	info, err := h.readInfo(id)
+	if err != nil {
+		writeInfoError(w, err)
+		return
+	}
+
+	if offset != info.Offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	f, err := h.Root.OpenFile(dataName(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// keep whatever arrived before a dropped connection, that is the point
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, info.Size-info.Offset))
+	syncErr := f.Sync()
+	closeErr := f.Close()
+	info.Offset += n
+
+	if copyErr != nil {
+		log.Printf("tus: upload %s interrupted at %d/%d: %v", id, info.Offset, info.Size, copyErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := errors.Join(syncErr, closeErr); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if info.Offset == info.Size {
+		if err := h.complete(info); err != nil {
+			h.completeFailed(w, info, err)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) terminate(w http.ResponseWriter, id string) {
+	unlock := h.lock(id)
+	defer unlock()
+
+	info, err := h.readInfo(id)
+	if err != nil {
+		writeInfoError(w, err)
+		return
+	}
+
+	if err := h.discard(info); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sweep removes uploads which weren't written to for maxAge, e.g. because
+// the client gave up on them, returning their IDs.
+func (h *Handler) Sweep(maxAge time.Duration) ([]string, error) {
+	entries, err := fs.ReadDir(h.Root.FS(), ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	cutoff := time.Now().Add(-maxAge)
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), infoSuffix)
+		if !ok || !validID(id) {
+			continue
+		}
+
+		swept, err := h.sweep(id, cutoff)
+		if err != nil {
+			return removed, err
+		}
+		if swept {
+			removed = append(removed, id)
+		}
+	}
+
+	return removed, nil
+}
+
+// sweep removes the upload with id if it wasn't written to since cutoff.
+func (h *Handler) sweep(id string, cutoff time.Time) (bool, error) {
+	unlock := h.lock(id)
+	defer unlock()
+
+	// the data file is appended to, the info file only written at first
+	fi, err := h.Root.Stat(dataName(id))
+	if errors.Is(err, os.ErrNotExist) {
+		fi, err = h.Root.Stat(infoName(id))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// completed or removed meanwhile
+		return false, nil
+	}
+	if err != nil || fi.ModTime().After(cutoff) {
+		return false, err
+	}
+
+	b, err := h.Root.ReadFile(infoName(id))
+	if err != nil {
+		return false, err
+	}
+	var info Info
+	if err := json.Unmarshal(b, &info); err != nil {
+		log.Printf("tus: upload %s: %v", id, err)
+	}
+	info.ID = id
+
+	return true, h.discard(info)
+}
+
+func (h *Handler) complete(info Info) error {
+	if h.OnComplete != nil {
+		if err := h.OnComplete(info, dataName(info.ID)); err != nil {
+			return fmt.Errorf("tus: finalizing upload %s: %w", info.ID, err)
+		}
+	}
+
+	return h.remove(info.ID)
+}
+
+func (h *Handler) completeFailed(w http.ResponseWriter, info Info, err error) {
+	log.Println(err)
+
+	status := h.errorStatus(err)
+	if status >= 400 && status < 500 {
+		if err := h.discard(info); err != nil {
+			log.Println(err)
+		}
+	}
+
+	w.WriteHeader(status)
+}
+
+func (h *Handler) errorStatus(err error) int {
+	if h.ErrorStatus == nil {
+		return http.StatusInternalServerError
+	}
+
+	return h.ErrorStatus(err)
+}
+
+// discard removes an upload which won't complete, telling OnDiscard.
+func (h *Handler) discard(info Info) error {
+	if err := h.remove(info.ID); err != nil {
+		return err
+	}
+	if h.OnDiscard != nil {
+		h.OnDiscard(info)
+	}
+
+	return nil
+}
+
+func (h *Handler) remove(id string) error {
+	err := h.Root.Remove(dataName(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return h.Root.Remove(infoName(id))
+}
+
+// lock serializes requests against a single upload.  Its lock is forgotten
+// once nobody holds or waits for it, so a request arriving meanwhile can't
+// get a lock of its own.
+func (h *Handler) lock(id string) func() {
+	h.mu.Lock()
+	l, ok := h.locks[id]
+	if !ok {
+		l = &uploadLock{}
+		h.locks[id] = l
+	}
+	l.refs++
+	h.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		h.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(h.locks, id)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *Handler) readInfo(id string) (Info, error) {
+	var info Info
+	if !validID(id) {
+		return info, os.ErrNotExist
+	}
+
+	b, err := h.Root.ReadFile(infoName(id))
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return info, err
+	}
+
+	fi, err := h.Root.Stat(dataName(id))
+	if err != nil {
+		return info, err
+	}
+	info.Offset = fi.Size()
+
+	return info, nil
+}
+
+func (h *Handler) writeInfo(info Info) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return h.Root.WriteFile(infoName(info.ID), b, 0600)
+}
+
+func infoName(id string) string {
+	return id + infoSuffix
+}
+
+func dataName(id string) string {
+	return id + dataSuffix
+}
+
+func writeInfoError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	log.Println(err)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id could have been produced by newID, which keeps
+// request paths from naming any other file.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// ParseMetadata decodes an Upload-Metadata header.
+func ParseMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata pair %q", pair)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(decoded)
+	}
+
+	return metadata, nil
+}
+
+// FormatMetadata encodes metadata as an Upload-Metadata header.
+func FormatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for k, v := range metadata {
+		pairs = append(pairs, k+" "+base64.StdEncoding.EncodeToString([]byte(v)))
+	}
+
+	return strings.Join(pairs, ",")
+}
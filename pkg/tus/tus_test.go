@@ -0,0 +1,168 @@
+package tus
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func do(t *testing.T, h http.Handler, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", Version)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// openRoot opens a temporary directory to keep partial uploads in.
+func openRoot(t *testing.T) *os.Root {
+	t.Helper()
+
+	root, err := os.OpenRoot(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = root.Close() })
+
+	return root
+}
+
+func TestResumableUpload(t *testing.T) {
+	root := openRoot(t)
+	dst := filepath.Join(t.TempDir(), "done")
+
+	var completed Info
+	newHandler := func() *Handler {
+		return New("/files", root, func(info Info, name string) error {
+			completed = info
+			return os.Rename(filepath.Join(root.Name(), name), dst)
+		})
+	}
+	h := newHandler()
+
+	rec := do(t, h, http.MethodPost, "/files/", "", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": FormatMetadata(map[string]string{"filename": "hello.txt"}),
+	})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location := rec.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "/files/"))
+
+	patch := map[string]string{"Content-Type": offsetContentType, "Upload-Offset": "0"}
+	rec = do(t, h, http.MethodPatch, location, "hello", patch)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+
+	// a stale offset is a conflict
+	rec = do(t, h, http.MethodPatch, location, "hello", patch)
+	require.Equal(t, http.StatusConflict, rec.Code)
+
+	// a restarted server picks up where the last one left off
+	h = newHandler()
+	rec = do(t, h, http.MethodHead, location, "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "5", rec.Header().Get("Upload-Offset"))
+	require.Equal(t, "11", rec.Header().Get("Upload-Length"))
+
+	patch["Upload-Offset"] = "5"
+	rec = do(t, h, http.MethodPatch, location, " world", patch)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "11", rec.Header().Get("Upload-Offset"))
+
+	require.Equal(t, "hello.txt", completed.Metadata["filename"])
+	b, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+
+	rec = do(t, h, http.MethodHead, location, "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestTerminate(t *testing.T) {
+	h := New("/files", openRoot(t), nil)
+	var discarded []Info
+	h.OnDiscard = func(info Info) { discarded = append(discarded, info) }
+
+	rec := do(t, h, http.MethodPost, "/files", "", map[string]string{"Upload-Length": "3"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	location := rec.Header().Get("Location")
+
+	rec = do(t, h, http.MethodDelete, location, "", nil)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Len(t, discarded, 1)
+	require.Equal(t, int64(3), discarded[0].Size)
+	require.Equal(t, "192.0.2.1", discarded[0].Client)
+
+	rec = do(t, h, http.MethodHead, location, "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	entries, err := fs.ReadDir(h.Root.FS(), ".")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Empty(t, h.locks)
+}
+
+func TestSweep(t *testing.T) {
+	h := New("/files", openRoot(t), nil)
+	var discarded []Info
+	h.OnDiscard = func(info Info) { discarded = append(discarded, info) }
+
+	create := func() string {
+		rec := do(t, h, http.MethodPost, "/files", "", map[string]string{"Upload-Length": "3"})
+		require.Equal(t, http.StatusCreated, rec.Code)
+		return rec.Header().Get("Location")
+	}
+	stale, fresh := create(), create()
+	staleID := strings.TrimPrefix(stale, "/files/")
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, h.Root.Chtimes(infoName(staleID), old, old))
+	require.NoError(t, h.Root.Chtimes(dataName(staleID), old, old))
+
+	removed, err := h.Sweep(time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{staleID}, removed)
+	require.Len(t, discarded, 1)
+	require.Equal(t, staleID, discarded[0].ID)
+	require.Equal(t, int64(3), discarded[0].Size)
+
+	require.Equal(t, http.StatusNotFound, do(t, h, http.MethodHead, stale, "", nil).Code)
+	require.Equal(t, http.StatusOK, do(t, h, http.MethodHead, fresh, "", nil).Code)
+	require.Empty(t, h.locks)
+}
+
+func TestRejects(t *testing.T) {
+	h := New("/files", openRoot(t), nil)
+	h.MaxSize = 10
+
+	rec := do(t, h, http.MethodPost, "/files/", "", map[string]string{"Upload-Length": "11"})
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = do(t, h, http.MethodHead, "/files/../../etc/passwd", "", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	req := httptest.NewRequest(http.MethodPost, "/files/", nil)
+	req.Header.Set("Upload-Length", "1")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusPreconditionFailed, rec.Code)
+}
+
+func TestMetadata(t *testing.T) {
+	m, err := ParseMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,is_confidential")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"filename": "world_domination_plan.pdf", "is_confidential": ""}, m)
+
+	_, err = ParseMetadata("filename !!!")
+	require.Error(t, err)
+}
@@ -1,5 +0,0 @@
-//go:build !openbsd
-
-package unveil
-
-func Unveil(...string) error { return nil }
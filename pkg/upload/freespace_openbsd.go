@@ -0,0 +1,16 @@
+//go:build openbsd
+
+package upload
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir.
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return st.F_bavail * int64(st.F_bsize), nil
+}
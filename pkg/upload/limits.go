@@ -0,0 +1,291 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type TooLargeErr struct {
+	Reason string
+}
+
+var _ error = &TooLargeErr{}
+
+func (m TooLargeErr) Error() string {
+	return fmt.Sprintf("upload too large: %s", m.Reason)
+}
+
+type InsufficientStorageErr struct {
+	Reason string
+}
+
+var _ error = &InsufficientStorageErr{}
+
+func (m InsufficientStorageErr) Error() string {
+	return fmt.Sprintf("insufficient storage: %s", m.Reason)
+}
+
+// Limits caps how much may be uploaded.  A zero value disables that limit.
+type Limits struct {
+	// MaxFileSize is the largest single upload accepted, in bytes.
+	MaxFileSize int64
+	// Quota is the most the upload directory may hold, in bytes.
+	Quota int64
+	// ClientDailyQuota is how many bytes a single client may upload per
+	// (UTC) day.
+	ClientDailyQuota int64
+	// MinFreeSpace is how many bytes must remain free on the filesystem
+	// after an upload.
+	MinFreeSpace int64
+}
+
+const (
+	// rescanInterval is how long the size of Dir is kept track of before
+	// it's measured again, once nothing is being uploaded, picking up
+	// files replaced or removed meanwhile.
+	rescanInterval = time.Minute
+	// freeSpaceInterval is how many bytes of an upload are read between
+	// checks of the free space left.
+	freeSpaceInterval = 1 << 20
+)
+
+// Limiter enforces Limits for uploads into Dir.
+type Limiter struct {
+	Limits
+	Dir string
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+	// stored is how many bytes Dir holds, counting uploads in progress and
+	// charged ones, as of scanned
+	stored  int64
+	scanned time.Time
+	// active is how many uploads are being read
+	active int
+	now    func() time.Time
+}
+
+type clientUsage struct {
+	day   string
+	bytes int64
+}
+
+// NewLimiter returns a Limiter enforcing limits for uploads into dir.
+func NewLimiter(dir string, limits Limits) *Limiter {
+	return &Limiter{
+		Limits:  limits,
+		Dir:     dir,
+		clients: map[string]*clientUsage{},
+		now:     time.Now,
+	}
+}
+
+// Check reports whether client may upload size more bytes, before any of
+// them are written.  size may span several files, so MaxFileSize is left to
+// Reader.  A negative size means it isn't known up front, in which case only
+// limits which are already exhausted are reported, leaving the rest to
+// Reader.
+func (l *Limiter) Check(client string, size int64) error {
+	size = max(size, 0)
+
+	if l.ClientDailyQuota > 0 {
+		if remaining := l.clientRemaining(client); remaining <= 0 || size > remaining {
+			return TooLargeErr{fmt.Sprintf("daily quota of %d bytes for %s exhausted", l.ClientDailyQuota, client)}
+		}
+	}
+
+	if l.Quota > 0 {
+		used, err := l.storedBytes()
+		if err != nil {
+			return err
+		}
+		if used+size > l.Quota {
+			return InsufficientStorageErr{fmt.Sprintf("upload quota of %d bytes reached", l.Quota)}
+		}
+	}
+
+	return l.checkFreeSpace(size)
+}
+
+// checkFreeSpace reports whether size more bytes still leave MinFreeSpace.
+func (l *Limiter) checkFreeSpace(size int64) error {
+	free, err := freeSpace(l.Dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free-size < l.MinFreeSpace || free < size {
+		return InsufficientStorageErr{fmt.Sprintf("only %d bytes free", free)}
+	}
+
+	return nil
+}
+
+// Charge counts n bytes against client's daily quota, and the upload quota.
+func (l *Limiter) Charge(client string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ClientDailyQuota > 0 {
+		l.usage(client).bytes += n
+	}
+	l.stored += n
+}
+
+// Refund undoes charging client n bytes for an upload given up on, e.g. a
+// resumable one charged up front.  It's refunded to client's daily quota
+// only on the day it was charged, as far as that can be told.
+func (l *Limiter) Refund(client string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if u, ok := l.clients[client]; ok && u.day == l.now().UTC().Format(time.DateOnly) {
+		u.bytes = max(u.bytes-n, 0)
+	}
+	l.stored = max(l.stored-n, 0)
+}
+
+// Reader wraps the body of a single upload from client, charging what is
+// read against its daily quota and the upload quota, and failing with
+// TooLargeErr or InsufficientStorageErr once a limit is exceeded or free
+// space runs low.  Done must be called once the upload is stored, or given
+// up on.
+func (l *Limiter) Reader(client string, r io.Reader) *LimitedReader {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active++
+
+	// check the free space before the first byte is written
+	return &LimitedReader{l: l, client: client, r: r, unchecked: freeSpaceInterval}
+}
+
+// storedBytes returns how many bytes Dir holds, measuring it when first
+// needed and again once rescanInterval has passed without any upload in
+// progress.
+func (l *Limiter) storedBytes() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.scanned.IsZero() && (l.active > 0 || l.now().Sub(l.scanned) < rescanInterval) {
+		return l.stored, nil
+	}
+
+	stored, err := dirSize(l.Dir)
+	if err != nil {
+		return 0, err
+	}
+	l.stored = stored
+	l.scanned = l.now()
+
+	return l.stored, nil
+}
+
+func (l *Limiter) clientRemaining(client string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ClientDailyQuota - l.usage(client).bytes
+}
+
+// usage returns client's usage for today; l.mu must be held.
+func (l *Limiter) usage(client string) *clientUsage {
+	day := l.now().UTC().Format(time.DateOnly)
+
+	u, ok := l.clients[client]
+	if !ok || u.day != day {
+		u = &clientUsage{day: day}
+		l.clients[client] = u
+	}
+
+	return u
+}
+
+// LimitedReader is the body of an upload being read.
+type LimitedReader struct {
+	l      *Limiter
+	client string
+	r      io.Reader
+	read   int64
+	// unchecked is how many bytes were read since free space was checked
+	unchecked int64
+	done      bool
+}
+
+func (lr *LimitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.read += int64(n)
+	lr.unchecked += int64(n)
+	lr.l.Charge(lr.client, int64(n))
+
+	if lr.l.MaxFileSize > 0 && lr.read > lr.l.MaxFileSize {
+		return n, TooLargeErr{fmt.Sprintf("exceeds the %d byte limit", lr.l.MaxFileSize)}
+	}
+	if lr.l.ClientDailyQuota > 0 && lr.l.clientRemaining(lr.client) < 0 {
+		return n, TooLargeErr{fmt.Sprintf("daily quota of %d bytes for %s exhausted", lr.l.ClientDailyQuota, lr.client)}
+	}
+	if lr.l.Quota > 0 {
+		stored, serr := lr.l.storedBytes()
+		if serr != nil {
+			return n, serr
+		}
+		if stored > lr.l.Quota {
+			return n, InsufficientStorageErr{fmt.Sprintf("upload quota of %d bytes reached", lr.l.Quota)}
+		}
+	}
+	if lr.l.MinFreeSpace > 0 && lr.unchecked >= freeSpaceInterval {
+		lr.unchecked = 0
+		if err := lr.l.checkFreeSpace(0); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+// Done stops counting the upload as in progress, and no longer counts it
+// against the upload quota unless it was stored.  The daily quota stays
+// charged either way.
+func (lr *LimitedReader) Done(stored bool) {
+	lr.l.mu.Lock()
+	defer lr.l.mu.Unlock()
+
+	if lr.done {
+		return
+	}
+	lr.done = true
+
+	lr.l.active--
+	if !stored {
+		lr.l.stored -= lr.read
+	}
+}
+
+// dirSize sums the size of every regular file below dir.
+func dirSize(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+
+	return total, err
+}
@@ -0,0 +1,114 @@
+package upload
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxFileSize(t *testing.T) {
+	l := NewLimiter(t.TempDir(), Limits{MaxFileSize: 4})
+
+	_, err := io.ReadAll(l.Reader("10.0.0.1", strings.NewReader("1234")))
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(l.Reader("10.0.0.1", strings.NewReader("12345")))
+	require.ErrorAs(t, err, &TooLargeErr{})
+}
+
+func TestQuota(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing"), []byte("123456"), 0600))
+	l := NewLimiter(dir, Limits{Quota: 10})
+
+	require.NoError(t, l.Check("10.0.0.1", 4))
+	require.ErrorAs(t, l.Check("10.0.0.1", 5), &InsufficientStorageErr{})
+
+	// uploads of unknown size are stopped as they reach it
+	require.NoError(t, l.Check("10.0.0.1", -1))
+	lr := l.Reader("10.0.0.1", strings.NewReader("12345"))
+	_, err := io.ReadAll(lr)
+	require.ErrorAs(t, err, &InsufficientStorageErr{})
+	lr.Done(false)
+
+	// as are concurrent ones, together
+	first := l.Reader("10.0.0.1", strings.NewReader("123"))
+	second := l.Reader("10.0.0.2", strings.NewReader("12"))
+	_, err = io.ReadAll(first)
+	require.NoError(t, err)
+	_, err = io.ReadAll(second)
+	require.ErrorAs(t, err, &InsufficientStorageErr{})
+	first.Done(true)
+	second.Done(false)
+
+	// stored uploads count without measuring the directory again
+	require.NoError(t, l.Check("10.0.0.1", 1))
+	require.ErrorAs(t, l.Check("10.0.0.1", 2), &InsufficientStorageErr{})
+}
+
+func TestClientDailyQuota(t *testing.T) {
+	l := NewLimiter(t.TempDir(), Limits{ClientDailyQuota: 10})
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	_, err := io.ReadAll(l.Reader("10.0.0.1", strings.NewReader("12345678")))
+	require.NoError(t, err)
+
+	require.NoError(t, l.Check("10.0.0.1", 2))
+	require.ErrorAs(t, l.Check("10.0.0.1", 3), &TooLargeErr{})
+
+	_, err = io.ReadAll(l.Reader("10.0.0.1", strings.NewReader("123")))
+	require.ErrorAs(t, err, &TooLargeErr{})
+
+	// other clients are unaffected
+	require.NoError(t, l.Check("10.0.0.2", 10))
+
+	// and the quota resets the next day
+	now = now.Add(24 * time.Hour)
+	require.NoError(t, l.Check("10.0.0.1", 10))
+}
+
+func TestRefund(t *testing.T) {
+	l := NewLimiter(t.TempDir(), Limits{Quota: 10, ClientDailyQuota: 10})
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	require.NoError(t, l.Check("10.0.0.1", 8))
+	l.Charge("10.0.0.1", 8)
+	require.Error(t, l.Check("10.0.0.1", 3))
+
+	// an upload given up on no longer counts against either quota
+	l.Refund("10.0.0.1", 8)
+	require.NoError(t, l.Check("10.0.0.1", 10))
+
+	// a refund for yesterday's doesn't add to today's
+	l.Charge("10.0.0.1", 8)
+	now = now.Add(24 * time.Hour)
+	l.Refund("10.0.0.1", 8)
+	l.Charge("10.0.0.1", 8)
+	require.ErrorAs(t, l.Check("10.0.0.1", 3), &TooLargeErr{})
+}
+
+func TestMinFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	l := NewLimiter(dir, Limits{})
+	require.NoError(t, l.Check("10.0.0.1", 0))
+	require.ErrorAs(t, l.Check("10.0.0.1", free+1), &InsufficientStorageErr{})
+
+	l.MinFreeSpace = free + 1
+	require.ErrorAs(t, l.Check("10.0.0.1", 0), &InsufficientStorageErr{})
+
+	// free space is checked again while reading
+	_, err = io.ReadAll(l.Reader("10.0.0.1", strings.NewReader("1")))
+	require.ErrorAs(t, err, &InsufficientStorageErr{})
+}
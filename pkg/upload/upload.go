@@ -0,0 +1,274 @@
+// Package upload places uploaded files into the upload directory, applying
+// the configured policy when a file of the same name already exists.
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stensonb/fileserver/pkg/safepath"
+)
+
+// VersionsDir is the hidden folder, relative to the upload directory, where
+// the version policy keeps prior copies of overwritten files.
+const VersionsDir = ".versions"
+
+// StagingPrefix starts the name of the hidden files uploads are written to
+// before being renamed into place.
+const StagingPrefix = ".upload-"
+
+// DefaultMaxDepth is how many path segments an upload's name may have,
+// unless the Store says otherwise.
+const DefaultMaxDepth = 16
+
+type ConflictPolicy string
+
+const (
+	// Overwrite replaces the existing file.
+	Overwrite ConflictPolicy = "overwrite"
+	// Reject refuses the upload.
+	Reject ConflictPolicy = "reject"
+	// Rename stores the upload under the first free "name (n).ext".
+	Rename ConflictPolicy = "rename"
+	// Version moves the existing file into VersionsDir, then overwrites it.
+	Version ConflictPolicy = "version"
+)
+
+// ConflictPolicies lists every supported policy.
+var ConflictPolicies = []ConflictPolicy{Overwrite, Reject, Rename, Version}
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for _, p := range ConflictPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown upload conflict policy %q (want one of %v)", s, ConflictPolicies)
+}
+
+type BadNameErr struct {
+	Name string
+	Err  error
+}
+
+var _ error = &BadNameErr{}
+
+func (m BadNameErr) Error() string {
+	return fmt.Sprintf("bad upload name %q: %v", m.Name, m.Err)
+}
+
+func (m BadNameErr) Unwrap() error {
+	return m.Err
+}
+
+type ConflictErr struct {
+	Name string
+}
+
+var _ error = &ConflictErr{}
+
+func (m ConflictErr) Error() string {
+	return fmt.Sprintf("%q already exists", m.Name)
+}
+
+// Store writes uploads into Root.  Names may be relative paths (e.g. from a
+// folder upload), whose directories are created as needed.  Every access
+// goes through Root, so neither ".." nor a symlink can lead outside it.
+type Store struct {
+	Root     *os.Root
+	Conflict ConflictPolicy
+	MaxDepth uint
+
+	// mu serializes choosing a final name, so two uploads can never both
+	// claim the same one.
+	mu sync.Mutex
+}
+
+// New returns a Store for root using the given conflict policy.
+func New(root *os.Root, conflict ConflictPolicy) *Store {
+	return &Store{Root: root, Conflict: conflict, MaxDepth: DefaultMaxDepth}
+}
+
+// Save copies src into the store as name, returning the name it was
+// actually stored under.  The data is first written to a hidden staging file
+// and only renamed into place once it is complete and synced to disk, so an
+// interrupted upload never shows up as a truncated file.
+func (s *Store) Save(name string, src io.Reader) (string, error) {
+	safeName, err := s.cleanName(name)
+	if err != nil {
+		return "", err
+	}
+
+	staging, stagingName, err := s.createStaging()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = staging.Close()
+		// a no-op once the file has been placed
+		_ = s.Root.Remove(stagingName)
+	}()
+
+	if _, err := io.Copy(staging, src); err != nil {
+		return "", err
+	}
+	if err := staging.Sync(); err != nil {
+		return "", err
+	}
+	if err := staging.Close(); err != nil {
+		return "", err
+	}
+
+	return s.place(safeName, stagingName)
+}
+
+// Move renames the file at path, relative to Root, into the store as name,
+// returning the name it was actually stored under.
+func (s *Store) Move(name, path string) (string, error) {
+	safeName, err := s.cleanName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return s.place(safeName, path)
+}
+
+// Sweep removes staging files left behind by uploads interrupted more than
+// maxAge ago, e.g. by a crash.
+func (s *Store) Sweep(maxAge time.Duration) ([]string, error) {
+	entries, err := fs.ReadDir(s.Root.FS(), ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	cutoff := time.Now().Add(-maxAge)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), StagingPrefix) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := s.Root.Remove(e.Name()); err != nil {
+			return removed, err
+		}
+		removed = append(removed, e.Name())
+	}
+
+	return removed, nil
+}
+
+// createStaging creates a new, empty staging file.  Like os.Create, it's
+// readable by others as far as the umask allows, as is the upload it becomes.
+func (s *Store) createStaging() (*os.File, string, error) {
+	for {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+
+		name := StagingPrefix + hex.EncodeToString(b)
+		f, err := s.Root.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, name, err
+	}
+}
+
+// place renames the file at path to safeName, applying the conflict policy.
+func (s *Store) place(safeName, path string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := safeName
+	if _, err := s.Root.Lstat(safeName); err == nil {
+		switch s.Conflict {
+		case Reject:
+			return "", ConflictErr{safeName}
+		case Rename:
+			stored, err = s.freeName(safeName)
+			if err != nil {
+				return "", err
+			}
+		case Version:
+			if err := s.keepVersion(safeName); err != nil {
+				return "", err
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := s.Root.MkdirAll(filepath.Dir(stored), 0777); err != nil {
+		return "", err
+	}
+
+	return stored, s.Root.Rename(path, stored)
+}
+
+// freeName returns the first "name (n).ext" which doesn't exist yet.
+func (s *Store) freeName(name string) (string, error) {
+	for n := 1; ; n++ {
+		candidate := numbered(name, n)
+		_, err := s.Root.Lstat(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// keepVersion moves an existing name into VersionsDir, stamped with the
+// time it was replaced.
+func (s *Store) keepVersion(name string) error {
+	if _, err := s.Root.Lstat(name); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405.000000000Z")
+	version := filepath.Join(VersionsDir, name+"."+stamp)
+	if err := s.Root.MkdirAll(filepath.Dir(version), 0777); err != nil {
+		return err
+	}
+
+	return s.Root.Rename(name, version)
+}
+
+func (s *Store) cleanName(name string) (string, error) {
+	safeName, err := safepath.CleanRelative(name, s.MaxDepth)
+	if err != nil {
+		return "", BadNameErr{name, err}
+	}
+
+	// dot files are reserved for the server's own bookkeeping
+	for _, segment := range strings.Split(safeName, string(filepath.Separator)) {
+		if strings.HasPrefix(segment, ".") {
+			return "", BadNameErr{name, safepath.BadCharactersFoundErr{}}
+		}
+	}
+
+	return safeName, nil
+}
+
+// numbered returns "report (n).pdf" for "report.pdf".
+func numbered(name string, n int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
@@ -0,0 +1,216 @@
+package upload
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func newStore(t *testing.T, policy ConflictPolicy) *Store {
+	t.Helper()
+
+	root, err := os.OpenRoot(t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = root.Close() })
+
+	return New(root, policy)
+}
+
+func TestConflictPolicies(t *testing.T) {
+	cases := map[ConflictPolicy]struct {
+		stored   string
+		existing string
+		err      error
+	}{
+		Overwrite: {stored: "report.pdf", existing: "second"},
+		Reject:    {existing: "first", err: &ConflictErr{}},
+		Rename:    {stored: "report (1).pdf", existing: "first"},
+		Version:   {stored: "report.pdf", existing: "second"},
+	}
+
+	for policy, tc := range cases {
+		t.Run(string(policy), func(t *testing.T) {
+			s := newStore(t, policy)
+
+			stored, err := s.Save("report.pdf", strings.NewReader("first"))
+			require.NoError(t, err)
+			require.Equal(t, "report.pdf", stored)
+
+			stored, err = s.Save("report.pdf", strings.NewReader("second"))
+			if tc.err != nil {
+				require.ErrorAs(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.stored, stored)
+			require.Equal(t, tc.existing, read(t, filepath.Join(s.Root.Name(), "report.pdf")))
+		})
+	}
+}
+
+func TestRenameCounts(t *testing.T) {
+	s := newStore(t, Rename)
+
+	for _, want := range []string{"notes", "notes (1)", "notes (2)"} {
+		stored, err := s.Save("notes", strings.NewReader(want))
+		require.NoError(t, err)
+		require.Equal(t, want, stored)
+	}
+}
+
+func TestVersionKeepsPriorCopies(t *testing.T) {
+	s := newStore(t, Version)
+
+	for _, content := range []string{"v1", "v2", "v3"} {
+		_, err := s.Save("doc.txt", strings.NewReader(content))
+		require.NoError(t, err)
+	}
+	require.Equal(t, "v3", read(t, filepath.Join(s.Root.Name(), "doc.txt")))
+
+	versions, err := os.ReadDir(filepath.Join(s.Root.Name(), VersionsDir))
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	for _, v := range versions {
+		require.True(t, strings.HasPrefix(v.Name(), "doc.txt."))
+	}
+}
+
+func TestMove(t *testing.T) {
+	s := newStore(t, Rename)
+
+	_, err := s.Save("a.bin", strings.NewReader("first"))
+	require.NoError(t, err)
+
+	src := filepath.Join(s.Root.Name(), "partial")
+	require.NoError(t, os.WriteFile(src, []byte("second"), 0600))
+
+	stored, err := s.Move("a.bin", "partial")
+	require.NoError(t, err)
+	require.Equal(t, "a (1).bin", stored)
+	require.Equal(t, "second", read(t, filepath.Join(s.Root.Name(), stored)))
+}
+
+func TestBadNames(t *testing.T) {
+	s := newStore(t, Overwrite)
+
+	for _, name := range []string{"", ".", ".versions", "../escape", "/abs", "a/.git/config", "a//b"} {
+		_, err := s.Save(name, strings.NewReader("x"))
+		require.ErrorAs(t, err, &BadNameErr{}, name)
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for _, p := range ConflictPolicies {
+		parsed, err := ParseConflictPolicy(string(p))
+		require.NoError(t, err)
+		require.Equal(t, p, parsed)
+	}
+
+	_, err := ParseConflictPolicy("clobber")
+	require.Error(t, err)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestInterruptedSaveLeavesNothing(t *testing.T) {
+	s := newStore(t, Overwrite)
+
+	_, err := s.Save("big.iso", io.MultiReader(strings.NewReader("partial"), failingReader{}))
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(s.Root.Name())
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSaveKeepsUsualMode(t *testing.T) {
+	s := newStore(t, Overwrite)
+
+	// what the umask makes of os.Create's mode
+	f, err := os.Create(filepath.Join(s.Root.Name(), "reference"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	reference, err := os.Stat(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.Save("docs/report.pdf", strings.NewReader("report"))
+	require.NoError(t, err)
+	fi, err := os.Stat(filepath.Join(s.Root.Name(), "docs", "report.pdf"))
+	require.NoError(t, err)
+	require.Equal(t, reference.Mode().Perm(), fi.Mode().Perm())
+}
+
+func TestSweep(t *testing.T) {
+	s := newStore(t, Overwrite)
+
+	stale := filepath.Join(s.Root.Name(), StagingPrefix+"stale")
+	fresh := filepath.Join(s.Root.Name(), StagingPrefix+"fresh")
+	kept := filepath.Join(s.Root.Name(), "kept")
+	for _, p := range []string{stale, fresh, kept} {
+		require.NoError(t, os.WriteFile(p, nil, 0600))
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, old, old))
+	require.NoError(t, os.Chtimes(kept, old, old))
+
+	removed, err := s.Sweep(time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{StagingPrefix + "stale"}, removed)
+
+	require.NoFileExists(t, stale)
+	require.FileExists(t, fresh)
+	require.FileExists(t, kept)
+}
+
+func TestFolderUpload(t *testing.T) {
+	s := newStore(t, Rename)
+	s.MaxDepth = 3
+
+	for _, name := range []string{"project/src/main.go", "project/src/main.go", "project/README"} {
+		_, err := s.Save(name, strings.NewReader(name))
+		require.NoError(t, err)
+	}
+	require.FileExists(t, filepath.Join(s.Root.Name(), "project", "src", "main.go"))
+	require.FileExists(t, filepath.Join(s.Root.Name(), "project", "src", "main (1).go"))
+	require.FileExists(t, filepath.Join(s.Root.Name(), "project", "README"))
+
+	_, err := s.Save("project/src/pkg/deep.go", strings.NewReader("x"))
+	require.ErrorAs(t, err, &BadNameErr{})
+}
+
+func TestSymlinksCannotEscape(t *testing.T) {
+	s := newStore(t, Overwrite)
+	outside := t.TempDir()
+
+	require.NoError(t, os.Symlink(outside, filepath.Join(s.Root.Name(), "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "file"), filepath.Join(s.Root.Name(), "file")))
+
+	_, err := s.Save("escape/file", strings.NewReader("x"))
+	require.Error(t, err)
+
+	_, err = s.Save("file", strings.NewReader("x"))
+	require.NoError(t, err)
+
+	// the symlink itself was replaced, nothing was written through it
+	entries, err := os.ReadDir(outside)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
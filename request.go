@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stensonb/fileserver/pkg/safepath"
+	"github.com/stensonb/fileserver/pkg/share"
+)
+
+const (
+	// requestPrefix is where upload requests are served.
+	requestPrefix = "/r/"
+	// requestMintPath is where admins mint upload requests.
+	requestMintPath = "/upload-request"
+)
+
+//go:embed templates/request.html
+var templates embed.FS
+
+var requestTemplate = template.Must(template.ParseFS(templates, "templates/request.html"))
+
+// mintUploadRequest returns an upload request, and its token, for uploading
+// into folder, relative to uploadDir, until expiry, at most maxBytes and
+// maxFiles in all (0 for no limit).
+func mintUploadRequest(folder string, expiry time.Duration, maxBytes int64, maxFiles int) (share.Request, string, error) {
+	cleaned, err := safepath.CleanRelative(folder, uploadMaxDepth)
+	if err != nil {
+		return share.Request{}, "", fmt.Errorf("folder %q: %w", folder, err)
+	}
+	for _, segment := range strings.Split(cleaned, string(filepath.Separator)) {
+		// dot files are reserved for the server's own bookkeeping
+		if strings.HasPrefix(segment, ".") {
+			return share.Request{}, "", fmt.Errorf("folder %q: %w", folder, safepath.BadCharactersFoundErr{})
+		}
+	}
+	if expiry <= 0 || maxBytes < 0 || maxFiles < 0 {
+		return share.Request{}, "", errors.New("upload requests need a positive expiry, and limits can't be negative")
+	}
+
+	req := share.Request{Folder: filepath.ToSlash(cleaned), Expires: time.Now().Add(expiry), MaxBytes: maxBytes, MaxFiles: maxFiles}
+	token, err := shares.MintRequest(req)
+
+	return req, token, err
+}
+
+// printUploadRequest mints an upload request for uploadRequestFolder, and
+// prints it for every URL the server is reachable at, with its QR code.
+func printUploadRequest(urls []url.URL) error {
+	expiry, err := time.ParseDuration(uploadRequestExpiry)
+	if err != nil {
+		return err
+	}
+
+	req, token, err := mintUploadRequest(uploadRequestFolder, expiry, uploadRequestMaxSize, uploadRequestMaxFiles)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Upload request into %s, %s:\n", req.Folder, describeUploadRequest(req))
+	if len(urls) == 0 {
+		fmt.Println(requestPrefix + token + "/")
+	}
+	for _, u := range urls {
+		u.Path = requestPrefix + token + "/"
+		fmt.Println(u.String())
+		if printQRCode {
+			fmt.Print(getQRCode(u.String()))
+		}
+	}
+
+	return nil
+}
+
+func describeUploadRequest(req share.Request) string {
+	s := "expiring " + req.Expires.Local().Format(time.DateTime)
+	if req.MaxFiles > 0 {
+		s += fmt.Sprintf(", for %d file(s)", req.MaxFiles)
+	}
+	if req.MaxBytes > 0 {
+		s += fmt.Sprintf(", for %d bytes", req.MaxBytes)
+	}
+
+	return s
+}
+
+// serveUploadRequestMint mints upload requests for admins: the form values
+// "folder", "expiry", "max-size" and "max-files" default to the
+// upload-request-* flags.  The link is returned, and printed on the
+// server's terminal with its QR code.
+func serveUploadRequestMint(w http.ResponseWriter, r *http.Request) {
+	expiry, err := time.ParseDuration(cmp.Or(r.FormValue("expiry"), uploadRequestExpiry))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxBytes, err := strconv.ParseInt(cmp.Or(r.FormValue("max-size"), strconv.FormatInt(uploadRequestMaxSize, 10)), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxFiles, err := strconv.Atoi(cmp.Or(r.FormValue("max-files"), strconv.Itoa(uploadRequestMaxFiles)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req, token, err := mintUploadRequest(r.FormValue("folder"), expiry, maxBytes, maxFiles)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u := url.URL{Scheme: "http", Host: r.Host, Path: requestPrefix + token + "/"}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	log.Printf("Upload request into %s, %s: %s\n", req.Folder, describeUploadRequest(req), u.String())
+	if printQRCode {
+		log.Printf("\n%s", getQRCode(u.String()))
+	}
+
+	_, _ = fmt.Fprintln(w, u.String())
+}
+
+// serveUploadRequest serves the upload page of an upload request.
+func serveUploadRequest(w http.ResponseWriter, r *http.Request) {
+	req, err := shares.CheckRequest(chi.URLParam(r, "token"))
+	if err != nil {
+		http.Error(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := requestTemplate.Execute(w, req); err != nil {
+		log.Println(err)
+	}
+}
+
+// serveUploadRequestAssets serves the upload page's scripts and styles to
+// holders of an upload request, who may have no access to /uploader.
+func serveUploadRequestAssets(fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := shares.CheckRequest(chi.URLParam(r, "token")); err != nil {
+			http.Error(w, err.Error(), shareErrorStatus(err))
+			return
+		}
+
+		http.ServeFileFS(w, r, fsys, "uploader/vendor/"+chi.URLParam(r, "*"))
+	}
+}
+
+// uploadRequestFile stores the files uploaded with an upload request in its
+// folder.
+func uploadRequestFile(w http.ResponseWriter, r *http.Request) {
+	receiveFiles(w, r, chi.URLParam(r, "token"))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stensonb/fileserver/pkg/share"
+	"github.com/stensonb/fileserver/pkg/upload"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadRequests(t *testing.T) {
+	oldUploadDir, oldStore, oldLimiter, oldShares := uploadDir, store, limiter, shares
+	t.Cleanup(func() { uploadDir, store, limiter, shares = oldUploadDir, oldStore, oldLimiter, oldShares })
+
+	uploadDir = t.TempDir()
+	root, err := os.OpenRoot(uploadDir)
+	require.NoError(t, err)
+	defer func() { _ = root.Close() }()
+	store = upload.New(root, upload.Reject)
+	limiter = upload.NewLimiter(uploadDir, upload.Limits{})
+	shares, err = share.Open(t.TempDir())
+	require.NoError(t, err)
+
+	for _, folder := range []string{"", "../up", ".tus", "a/.hidden", "/abs"} {
+		_, _, err := mintUploadRequest(folder, time.Hour, 0, 0)
+		require.Error(t, err, folder)
+	}
+	_, token, err := mintUploadRequest("from/alice", time.Hour, 0, 1)
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Get(requestPrefix+"{token}/", serveUploadRequest)
+	r.Post(requestPrefix+"{token}/upload", uploadRequestFile)
+
+	post := func(relativePath, content string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		if relativePath != "" {
+			require.NoError(t, mw.WriteField("relativePath", relativePath))
+		}
+		fw, err := mw.CreateFormFile("file", "a.txt")
+		require.NoError(t, err)
+		_, _ = fw.Write([]byte(content))
+		require.NoError(t, mw.Close())
+
+		req := httptest.NewRequest(http.MethodPost, requestPrefix+token+"/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, requestPrefix+token+"/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "up to 1 file(s)")
+
+	require.Equal(t, http.StatusBadRequest, post("../../escaped.txt", "nope"))
+	require.Equal(t, http.StatusOK, post("", "hello"))
+	require.Equal(t, http.StatusGone, post("", "again"))
+
+	b, err := os.ReadFile(filepath.Join(uploadDir, "from", "alice", "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+	_, err = os.Stat(filepath.Join(filepath.Dir(uploadDir), "escaped.txt"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, requestPrefix+"x"+token+"/", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
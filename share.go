@@ -0,0 +1,239 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stensonb/fileserver/pkg/share"
+)
+
+const (
+	// sharePrefix is where share links are served.
+	sharePrefix = "/s/"
+	// shareMintPath is where admins mint share links.
+	shareMintPath = "/share"
+)
+
+// sharesDir holds the key share links are signed with, and their download
+// counts.
+func sharesDir() string {
+	return filepath.Join(configDir, "shares")
+}
+
+// mintShare returns a link, and its token, to the file at p, either
+// absolute or relative to dataDir, which expires after expiry and may be
+// used maxDownloads times (0 for no limit).
+func mintShare(root *os.Root, p string, expiry time.Duration, maxDownloads int) (share.Link, string, error) {
+	if filepath.IsAbs(p) {
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return share.Link{}, "", err
+		}
+		p = rel
+	}
+	if !filepath.IsLocal(p) {
+		return share.Link{}, "", fmt.Errorf("%s is not in %s", p, dataDir)
+	}
+	if expiry <= 0 || maxDownloads < 0 {
+		return share.Link{}, "", errors.New("share links need a positive expiry, and max-downloads can't be negative")
+	}
+
+	link := share.Link{Path: filepath.ToSlash(filepath.Clean(p)), Expires: time.Now().Add(expiry), MaxDownloads: maxDownloads}
+	f, _, err := openShared(root, link.Path)
+	if err != nil {
+		return share.Link{}, "", fmt.Errorf("%s: %w", p, err)
+	}
+	_ = f.Close()
+
+	token, err := shares.Mint(link)
+
+	return link, token, err
+}
+
+// openShared opens the regular file at name in root, unless it's hidden
+// from /data.
+func openShared(root *os.Root, name string) (http.File, fs.FileInfo, error) {
+	f, err := hiddenFileSystem{http.FS(root.FS())}.Open("/" + name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = errors.New("not a regular file")
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+
+	return f, fi, nil
+}
+
+// printShareLink mints a link to shareFile, and prints it for every URL the
+// server is reachable at, with its QR code.
+func printShareLink(urls []url.URL) error {
+	expiry, err := time.ParseDuration(shareExpiry)
+	if err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dataDir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = root.Close() }()
+
+	link, token, err := mintShare(root, shareFile, expiry, shareMaxDownloads)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Share link to %s, %s:\n", link.Path, describeShare(link))
+	if len(urls) == 0 {
+		fmt.Println(sharePrefix + token)
+	}
+	for _, u := range urls {
+		u.Path = sharePrefix + token
+		fmt.Println(u.String())
+		if printQRCode {
+			fmt.Print(getQRCode(u.String()))
+		}
+	}
+
+	return nil
+}
+
+func describeShare(link share.Link) string {
+	s := "expiring " + link.Expires.Local().Format(time.DateTime)
+	if link.MaxDownloads > 0 {
+		s += fmt.Sprintf(" or after %d download(s)", link.MaxDownloads)
+	}
+
+	return s
+}
+
+// serveShareMint mints share links for admins: the form values "path",
+// "expiry" and "max-downloads" default to the share-* flags.  The link is
+// returned, and printed on the server's terminal with its QR code.
+func serveShareMint(root *os.Root) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expiry, err := time.ParseDuration(cmp.Or(r.FormValue("expiry"), shareExpiry))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		maxDownloads, err := strconv.Atoi(cmp.Or(r.FormValue("max-downloads"), strconv.Itoa(shareMaxDownloads)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filepath.IsAbs(r.FormValue("path")) {
+			http.Error(w, "path must be relative to the data directory", http.StatusBadRequest)
+			return
+		}
+
+		link, token, err := mintShare(root, r.FormValue("path"), expiry, maxDownloads)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u := url.URL{Scheme: "http", Host: r.Host, Path: sharePrefix + token}
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		log.Printf("Share link to %s, %s: %s\n", link.Path, describeShare(link), u.String())
+		if printQRCode {
+			log.Printf("\n%s", getQRCode(u.String()))
+		}
+
+		_, _ = fmt.Fprintln(w, u.String())
+	}
+}
+
+// serveShared serves the file a share link grants, counting the download.
+// Only responses with the file from its start count, so resuming a download,
+// or a player fetching ranges of a video, doesn't use the link up.
+func serveShared(root *os.Root) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+		link, err := shares.Check(token)
+		if err != nil {
+			http.Error(w, err.Error(), shareErrorStatus(err))
+			return
+		}
+
+		f, fi, err := openShared(root, link.Path)
+		if err != nil {
+			log.Println(err)
+			http.NotFound(w, r)
+			return
+		}
+		defer func() { _ = f.Close() }()
+
+		if r.Method != http.MethodHead {
+			w = &shareDownloadWriter{ResponseWriter: w, token: token, fromStart: strings.HasPrefix(r.Header.Get("Range"), "bytes=0-")}
+		}
+
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(link.Path)}))
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	}
+}
+
+// shareDownloadWriter counts a share link's download once the response turns
+// out to be one: the whole file, or a range from its start, rather than a
+// later range or a 304.  A download which can't be counted is refused.
+type shareDownloadWriter struct {
+	http.ResponseWriter
+	token     string
+	fromStart bool
+	refused   bool
+}
+
+func (w *shareDownloadWriter) WriteHeader(status int) {
+	if status == http.StatusOK || (status == http.StatusPartialContent && w.fromStart) {
+		if _, err := shares.Use(w.token); err != nil {
+			log.Println(err)
+			w.refused = true
+			w.Header().Del("Content-Disposition")
+			w.Header().Del("Content-Range")
+			http.Error(w.ResponseWriter, err.Error(), shareErrorStatus(err))
+			return
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *shareDownloadWriter) Write(p []byte) (int, error) {
+	if w.refused {
+		return len(p), nil
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func shareErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, share.ErrInvalid):
+		return http.StatusNotFound
+	case errors.Is(err, share.ErrExpired), errors.Is(err, share.ErrExhausted):
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
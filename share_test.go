@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stensonb/fileserver/pkg/share"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShareLinks(t *testing.T) {
+	oldDataDir, oldShares, oldQRCode := dataDir, shares, printQRCode
+	t.Cleanup(func() { dataDir, shares, printQRCode = oldDataDir, oldShares, oldQRCode })
+
+	dataDir = t.TempDir()
+	printQRCode = false
+	var err error
+	shares, err = share.Open(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dataDir, "docs"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "docs", "a.txt"), []byte("shared"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, ".hidden"), []byte("secret"), 0600))
+
+	root, err := os.OpenRoot(dataDir)
+	require.NoError(t, err)
+	defer func() { _ = root.Close() }()
+
+	for _, p := range []string{"docs", ".hidden", "../a.txt", "missing.txt", filepath.Join(t.TempDir(), "a.txt")} {
+		_, _, err := mintShare(root, p, time.Hour, 0)
+		require.Error(t, err, p)
+	}
+	_, _, err = mintShare(root, "docs/a.txt", 0, 0)
+	require.Error(t, err)
+
+	link, token, err := mintShare(root, filepath.Join(dataDir, "docs", "a.txt"), time.Hour, 1)
+	require.NoError(t, err)
+	require.Equal(t, "docs/a.txt", link.Path)
+
+	r := chi.NewRouter()
+	r.Get(sharePrefix+"{token}", serveShared(root))
+	r.Head(sharePrefix+"{token}", serveShared(root))
+	r.Post(shareMintPath, serveShareMint(root))
+
+	notModified := map[string]string{"If-Modified-Since": time.Now().UTC().Format(http.TimeFormat)}
+	cases := []struct {
+		method, path string
+		headers      map[string]string
+		status       int
+		body         string
+	}{
+		// HEAD requests, 304s and ranges past the start (e.g. resumed
+		// downloads) don't count as downloads
+		{http.MethodHead, sharePrefix + token, nil, http.StatusOK, ""},
+		{http.MethodGet, sharePrefix + token, notModified, http.StatusNotModified, ""},
+		{http.MethodGet, sharePrefix + token, map[string]string{"Range": "bytes=2-"}, http.StatusPartialContent, "ared"},
+		{http.MethodGet, sharePrefix + token, map[string]string{"Range": "bytes=0-1"}, http.StatusPartialContent, "sh"},
+		{http.MethodGet, sharePrefix + token, nil, http.StatusGone, ""},
+		{http.MethodGet, sharePrefix + "x" + token, nil, http.StatusNotFound, ""},
+		{http.MethodPost, shareMintPath + "?path=docs/a.txt&max-downloads=-1", nil, http.StatusBadRequest, ""},
+		{http.MethodPost, shareMintPath + "?path=" + filepath.Join(dataDir, "docs", "a.txt"), nil, http.StatusBadRequest, ""},
+		{http.MethodPost, shareMintPath + "?path=docs/a.txt&expiry=1h", nil, http.StatusOK, ""},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		require.Equal(t, c.status, rec.Code, c)
+		if c.body != "" {
+			require.Equal(t, c.body, rec.Body.String())
+			require.Equal(t, "attachment; filename=a.txt", rec.Header().Get("Content-Disposition"))
+		}
+		if c.method == http.MethodPost && c.status == http.StatusOK {
+			require.Contains(t, rec.Body.String(), "http://example.com"+sharePrefix)
+		}
+	}
+}
+
+func TestShareLinksCountFullDownloads(t *testing.T) {
+	oldDataDir, oldShares := dataDir, shares
+	t.Cleanup(func() { dataDir, shares = oldDataDir, oldShares })
+
+	dataDir = t.TempDir()
+	var err error
+	shares, err = share.Open(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "a.txt"), []byte("shared"), 0600))
+
+	root, err := os.OpenRoot(dataDir)
+	require.NoError(t, err)
+	defer func() { _ = root.Close() }()
+
+	_, token, err := mintShare(root, "a.txt", time.Hour, 1)
+	require.NoError(t, err)
+
+	r := chi.NewRouter()
+	r.Get(sharePrefix+"{token}", serveShared(root))
+
+	for _, status := range []int{http.StatusOK, http.StatusGone} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, sharePrefix+token, nil))
+		require.Equal(t, status, rec.Code)
+	}
+}
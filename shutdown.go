@@ -0,0 +1,126 @@
+package main
+
+import (
+	"cmp"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+)
+
+// transfer is an upload request in progress.
+type transfer struct {
+	id       uint64
+	client   string
+	request  string
+	started  time.Time
+	received atomic.Int64
+}
+
+// transfers tracks the upload requests in progress, so shutting down can
+// refuse new ones while waiting for, and reporting on, those already
+// running.
+type transfers struct {
+	mu       sync.Mutex
+	draining bool
+	nextID   uint64
+	active   map[uint64]*transfer
+}
+
+func newTransfers() *transfers {
+	return &transfers{active: make(map[uint64]*transfer)}
+}
+
+// track is middleware registering each request as a transfer, or refusing
+// it with 503 once draining.
+func (t *transfers) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr := t.start(ipfilter.ClientIP(r), r.Method+" "+r.URL.Path)
+		if tr == nil {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "the server is shutting down, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer t.finish(tr)
+
+		r.Body = &countingReader{ReadCloser: r.Body, n: &tr.received}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (t *transfers) start(client, request string) *transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return nil
+	}
+
+	t.nextID++
+	tr := &transfer{id: t.nextID, client: client, request: request, started: time.Now()}
+	t.active[tr.id] = tr
+
+	return tr
+}
+
+func (t *transfers) finish(tr *transfer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.active, tr.id)
+}
+
+// drain refuses every transfer from now on.
+func (t *transfers) drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.draining = true
+}
+
+// list returns the transfers in progress, oldest first.
+func (t *transfers) list() []*transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	active := make([]*transfer, 0, len(t.active))
+	for _, tr := range t.active {
+		active = append(active, tr)
+	}
+	slices.SortFunc(active, func(a, b *transfer) int { return cmp.Compare(a.id, b.id) })
+
+	return active
+}
+
+// logActive logs every transfer in progress, introduced by verb, e.g.
+// "Waiting for".
+func (t *transfers) logActive(verb string) {
+	active := t.list()
+	if len(active) == 0 {
+		log.Println("No uploads in progress.")
+		return
+	}
+
+	log.Printf("%s %d upload(s) in progress:", verb, len(active))
+	for _, tr := range active {
+		log.Printf("  %s from %s: %d bytes received in %s", tr.request, tr.client, tr.received.Load(), time.Since(tr.started).Round(time.Second))
+	}
+}
+
+// countingReader counts the bytes read through it into n.
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+
+	return n, err
+}
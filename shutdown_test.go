@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransfersDrain(t *testing.T) {
+	uploads := newTransfers()
+
+	var during []*transfer
+	h := uploads.track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(io.Discard, r.Body)
+		require.NoError(t, err)
+		during = uploads.list()
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/uploader/upload", strings.NewReader("12345")))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, during, 1)
+	require.Equal(t, "POST /uploader/upload", during[0].request)
+	require.Equal(t, int64(5), during[0].received.Load())
+	require.Empty(t, uploads.list())
+
+	uploads.drain()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/uploader/upload", strings.NewReader("12345")))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
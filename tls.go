@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stensonb/fileserver/pkg/certs"
+	"github.com/stensonb/fileserver/pkg/clientauth"
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// localCA signs the self-signed certificate, if one is in use.
+var localCA *certs.CA
+
+// tlsConfigSelfSigned issues a certificate for the given addresses from the
+// local CA persisted in configDir, creating the CA on first use.
+func tlsConfigSelfSigned(addresses []string) (*tls.Config, error) {
+	keyType, err := certs.ParseKeyType(tlsKeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	validity, err := time.ParseDuration(tlsValidity)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := certs.LoadOrCreateCA(configDir, fmt.Sprintf("%s local CA (%s)", name, hostname))
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := certificateHosts(hostname, addresses)
+	cert, err := ca.Issue(certs.LeafOptions{
+		CommonName: fmt.Sprintf("%s.%s", name, domain),
+		Hosts:      hosts,
+		Validity:   validity,
+		KeyType:    keyType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Issued %s certificate valid until %s for %s", keyType, cert.Leaf.NotAfter.Format(time.RFC3339), strings.Join(hosts, ", "))
+
+	log.Printf("Using local CA from %s, trust it by visiting /ca.crt (or /ca.mobileconfig on Apple devices)", configDir)
+	localCA = ca
+
+	return &tls.Config{
+		ServerName:   name,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// certificateHosts lists every name the server may be reached by: each
+// address it listens on (every interface's, for a wildcard address), the
+// machine's hostname, its mDNS ".local" name and localhost.
+func certificateHosts(hostname string, addresses []string) []string {
+	var hosts []string
+	for _, a := range addresses {
+		ip := net.ParseIP(a)
+		if a != "" && (ip == nil || !ip.IsUnspecified()) {
+			hosts = append(hosts, a)
+			continue
+		}
+
+		ifaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, ifaceAddr := range ifaceAddrs {
+			if ipnet, ok := ifaceAddr.(*net.IPNet); ok {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+
+	short, _, _ := strings.Cut(hostname, ".")
+	hosts = append(hosts, hostname, short+".local", "localhost", "127.0.0.1", "::1")
+
+	slices.Sort(hosts)
+	return slices.Compact(hosts)
+}
+
+// keyPairPollInterval is how often the certificate and key files are
+// checked for changes.
+const keyPairPollInterval = 30 * time.Second
+
+// tlsConfigFromFiles serves the certificate and key at tlsCertPath and
+// tlsKeyPath, reloading them when they change.
+func tlsConfigFromFiles() (*tls.Config, *certs.KeyPair, error) {
+	keyPair, err := certs.LoadKeyPair(tlsCertPath, tlsKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	logCertificate(keyPair.Certificate())
+
+	return &tls.Config{GetCertificate: keyPair.GetCertificate}, keyPair, nil
+}
+
+// watchKeyPair reloads keyPair whenever its files change, or on SIGHUP.
+func watchKeyPair(keyPair *certs.KeyPair) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(keyPairPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("SIGHUP received, reloading %s", keyPair.CertPath)
+		case <-ticker.C:
+			if !keyPair.Changed() {
+				continue
+			}
+			log.Printf("%s changed, reloading", keyPair.CertPath)
+		}
+
+		if err := keyPair.Reload(); err != nil {
+			log.Printf("keeping the current certificate: %v", err)
+			continue
+		}
+		logCertificate(keyPair.Certificate())
+	}
+}
+
+func logCertificate(cert *tls.Certificate) {
+	log.Printf("Using certificate for %s valid until %s", strings.Join(cert.Leaf.DNSNames, ", "), cert.Leaf.NotAfter.Format(time.RFC3339))
+}
+
+// keyPairDirs lists the directories the certificate and key files live in,
+// following symlinks, since renewals usually replace the files rather than
+// rewrite them.
+func keyPairDirs(paths ...string) []string {
+	var dirs []string
+	for _, p := range paths {
+		dirs = append(dirs, filepath.Dir(p))
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			dirs = append(dirs, filepath.Dir(resolved))
+		}
+	}
+
+	slices.Sort(dirs)
+	return slices.Compact(dirs)
+}
+
+// clientAuthModes parses the client certificate requirements for downloads
+// and uploads.
+func clientAuthModes() (download, upload clientauth.Mode, err error) {
+	download, err = clientauth.ParseMode(tlsClientAuth)
+	if err != nil {
+		return "", "", err
+	}
+
+	upload = download
+	if tlsClientAuthUpload != "" {
+		upload, err = clientauth.ParseMode(tlsClientAuthUpload)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return download, upload, nil
+}
+
+// requestClientCerts has cfg verify client certificates against
+// tlsClientCA as the modes need.
+func requestClientCerts(cfg *tls.Config, acme bool, modes ...clientauth.Mode) error {
+	roots, err := loadCertPool(tlsClientCA)
+	if err != nil {
+		return err
+	}
+
+	cfg.ClientCAs = roots
+	cfg.ClientAuth = clientauth.ClientAuthType(modes...)
+	if acme && cfg.ClientAuth == tls.RequireAndVerifyClientCert {
+		// the ACME server has no certificate to present when validating
+		// TLS-ALPN-01 challenges, so leave refusing clients to the routes
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return nil
+}
+
+// tlsFingerprint returns the SHA-256 fingerprint of the certificate the
+// server presents.
+func tlsFingerprint(cfg *tls.Config) []byte {
+	cert := &tls.Certificate{}
+	if cfg.GetCertificate != nil {
+		cert, _ = cfg.GetCertificate(&tls.ClientHelloInfo{})
+	} else if len(cfg.Certificates) > 0 {
+		cert = &cfg.Certificates[0]
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	return sum[:]
+}
+
+// formatFingerprint formats a fingerprint the way browsers display them,
+// e.g. "AB:CD:...".
+func formatFingerprint(fingerprint []byte) string {
+	parts := make([]string, len(fingerprint))
+	for i, b := range fingerprint {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// serveTLSFingerprint serves the fingerprint of the certificate currently
+// in use, which changes when it's reloaded.
+func serveTLSFingerprint(cfg *tls.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "SHA-256 fingerprint of this server's TLS certificate:\n%s\n", formatFingerprint(tlsFingerprint(cfg)))
+	}
+}
+
+// redirectRouter serves plain HTTP: requests are permanently redirected to
+// the same path at target (at the host the client asked for, if target has
+// none), except for the CA certificate, which devices need
+// before they can connect securely, to those filter admits, and ACME HTTP-01
+// challenges.
+func redirectRouter(target url.URL, acmeManager *autocert.Manager, filter *ipfilter.Filter, requestLogger func(http.Handler) http.Handler) http.Handler {
+	r := chi.NewRouter()
+	r.Use(ipfilter.TrustProxies(trustedProxies))
+	r.Use(middleware.RequestID)
+	r.Use(requestLogger)
+	r.Use(middleware.Recoverer)
+
+	if localCA != nil {
+		r.Group(func(r chi.Router) {
+			r.Use(filter.Enforce)
+			r.Get("/ca.crt", serveCACert)
+			r.Get("/ca.mobileconfig", serveCAMobileConfig)
+		})
+	}
+
+	redirect := func(w http.ResponseWriter, r *http.Request) {
+		u := target
+		if u.Hostname() == "" {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = strings.Trim(r.Host, "[]")
+			}
+			u.Host = net.JoinHostPort(host, u.Port())
+		}
+		u.Path = r.URL.Path
+		u.RawPath = r.URL.RawPath
+		u.RawQuery = r.URL.RawQuery
+		// 308 rather than 301, so uploads are resent as POSTs
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	}
+	r.NotFound(redirect)
+	r.MethodNotAllowed(redirect)
+
+	if acmeManager != nil {
+		return acmeManager.HTTPHandler(r)
+	}
+
+	return r
+}
+
+func serveCACert(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`-ca.crt"`)
+	_, _ = w.Write(localCA.CertPEM())
+}
+
+func serveCAMobileConfig(w http.ResponseWriter, r *http.Request) {
+	// profile identifiers are reverse-DNS, e.g. com.example.fileserver.ca
+	labels := strings.Split(domain, ".")
+	slices.Reverse(labels)
+	profile, err := localCA.MobileConfig(strings.Join(append(labels, name, "ca"), "."))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.mobileconfig"`)
+	_, _ = w.Write(profile)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/stensonb/fileserver/pkg/certs"
+	"github.com/stensonb/fileserver/pkg/ipfilter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertificateHosts(t *testing.T) {
+	hosts := certificateHosts("laptop.example.com", []string{"192.168.1.10"})
+	require.Equal(t, []string{"127.0.0.1", "192.168.1.10", "::1", "laptop.example.com", "laptop.local", "localhost"}, hosts)
+
+	// a wildcard address stands for every interface's
+	hosts = certificateHosts("laptop", []string{"0.0.0.0"})
+	require.NotContains(t, hosts, "0.0.0.0")
+	require.Contains(t, hosts, "laptop.local")
+	require.Contains(t, hosts, "127.0.0.1")
+}
+
+func TestFormatFingerprint(t *testing.T) {
+	require.Equal(t, "00:AB:FF", formatFingerprint([]byte{0x00, 0xab, 0xff}))
+}
+
+func TestRedirectRouter(t *testing.T) {
+	target := url.URL{Scheme: "https", Host: "192.168.1.10:1234"}
+	noop := func(next http.Handler) http.Handler { return next }
+	r := redirectRouter(target, nil, nil, noop)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, "http://192.168.1.10/data/a%20b.txt?x=1", nil))
+		require.Equal(t, http.StatusPermanentRedirect, rec.Code)
+		require.Equal(t, "https://192.168.1.10:1234/data/a%20b.txt?x=1", rec.Header().Get("Location"))
+	}
+
+	// without a host, the client's is kept
+	r = redirectRouter(url.URL{Scheme: "https", Host: ":1234"}, nil, nil, noop)
+	for host, want := range map[string]string{
+		"laptop.local":     "https://laptop.local:1234/",
+		"10.0.0.1:80":      "https://10.0.0.1:1234/",
+		"[fe80::1]":        "https://[fe80::1]:1234/",
+		"[2001:db8::1]:80": "https://[2001:db8::1]:1234/",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		require.Equal(t, want, rec.Header().Get("Location"), host)
+	}
+
+	// without a local CA, there's no certificate to hand out
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ca.crt", nil))
+	require.Equal(t, http.StatusPermanentRedirect, rec.Code)
+
+	ca, err := certs.LoadOrCreateCA(t.TempDir(), "test CA")
+	require.NoError(t, err)
+	localCA = ca
+	t.Cleanup(func() { localCA = nil })
+
+	rec = httptest.NewRecorder()
+	redirectRouter(target, nil, nil, noop).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ca.crt", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, ca.CertPEM(), rec.Body.Bytes())
+
+	// the address filters apply to it too
+	deny := &ipfilter.Filter{Deny: ipfilter.Prefixes{netip.MustParsePrefix("192.0.2.0/24")}}
+	rec = httptest.NewRecorder()
+	redirectRouter(target, nil, deny, noop).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ca.crt", nil))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}